@@ -0,0 +1,265 @@
+package mktree
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ArchiveFormat is the format of an archive written by an ArchiveFS.
+type ArchiveFormat int
+
+const (
+	ArchiveTar ArchiveFormat = iota
+	ArchiveTarGzip
+	ArchiveZip
+)
+
+func (f ArchiveFormat) String() string {
+	switch f {
+	case ArchiveTar:
+		return "tar"
+	case ArchiveTarGzip:
+		return "tar.gz"
+	case ArchiveZip:
+		return "zip"
+	}
+	return fmt.Sprintf("ArchiveFormat(%d)", int(f))
+}
+
+// ArchiveFormatFor returns the archive format implied by the extension of
+// filename: .tar, .tar.gz, .tgz or .zip.
+func ArchiveFormatFor(filename string) (ArchiveFormat, error) {
+	name := strings.ToLower(filename)
+	switch {
+	case strings.HasSuffix(name, ".tar"):
+		return ArchiveTar, nil
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return ArchiveTarGzip, nil
+	case strings.HasSuffix(name, ".zip"):
+		return ArchiveZip, nil
+	}
+	return 0, fmt.Errorf("unknown archive format for %q: must end with .tar, .tar.gz, .tgz or .zip", filename)
+}
+
+// ArchiveFile interprets the given file and writes the tree to w as an archive
+// instead of creating it. The other arguments are the same as for ExecFile.
+func (i *Interpreter) ArchiveFile(w io.Writer, format ArchiveFormat, r io.Reader, filename string, opts ...Option) error {
+	root := i.Root
+	if root == "" {
+		root = "."
+	}
+	a := NewArchiveFS(w, format, root)
+	opts = append(opts, WithFS(a))
+	if err := i.ExecFile(r, filename, opts...); err != nil {
+		return err
+	}
+	return a.Close()
+}
+
+// ArchiveFS is an FS that writes the entries created in it to an archive, named
+// relative to a root directory. Entries outside the root are not archived.
+//
+// Entries cannot be changed once they are written, so the tree must be
+// generated into an empty ArchiveFS. Zip archives cannot contain hard links, so
+// a hard link is archived as a copy of its target.
+type ArchiveFS struct {
+	// ModTime is the modification time of every entry. It defaults to the time
+	// NewArchiveFS was called.
+	ModTime time.Time
+
+	mem  MemFS
+	root string
+	gz   *gzip.Writer
+	tw   *tar.Writer
+	zw   *zip.Writer
+}
+
+var _ FS = (*ArchiveFS)(nil)
+
+var errArchiveModified = errors.New("cannot modify an entry that was written to an archive")
+
+// NewArchiveFS returns an ArchiveFS that writes to w. The caller must call Close
+// to finish the archive.
+func NewArchiveFS(w io.Writer, format ArchiveFormat, root string) *ArchiveFS {
+	a := &ArchiveFS{ModTime: time.Now(), root: filepath.Clean(root)}
+	switch format {
+	case ArchiveTarGzip:
+		a.gz = gzip.NewWriter(w)
+		a.tw = tar.NewWriter(a.gz)
+	case ArchiveZip:
+		a.zw = zip.NewWriter(w)
+	default:
+		a.tw = tar.NewWriter(w)
+	}
+	return a
+}
+
+// Close finishes writing the archive. It does not close the underlying writer.
+func (a *ArchiveFS) Close() error {
+	if a.zw != nil {
+		return a.zw.Close()
+	}
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	if a.gz != nil {
+		return a.gz.Close()
+	}
+	return nil
+}
+
+func (a *ArchiveFS) Lstat(name string) (fs.FileInfo, error)    { return a.mem.Lstat(name) }
+func (a *ArchiveFS) Stat(name string) (fs.FileInfo, error)     { return a.mem.Stat(name) }
+func (a *ArchiveFS) SameFile(fi1, fi2 fs.FileInfo) bool        { return a.mem.SameFile(fi1, fi2) }
+func (a *ArchiveFS) ReadFile(name string) ([]byte, error)      { return a.mem.ReadFile(name) }
+func (a *ArchiveFS) Readlink(name string) (string, error)      { return a.mem.Readlink(name) }
+func (a *ArchiveFS) Chmod(name string, mode fs.FileMode) error { return a.modified("chmod", name) }
+func (a *ArchiveFS) Rename(oldpath, newpath string) error      { return a.modified("rename", oldpath) }
+func (a *ArchiveFS) Remove(name string) error                  { return a.modified("remove", name) }
+func (a *ArchiveFS) RemoveAll(name string) error               { return a.modified("unlinkat", name) }
+
+func (a *ArchiveFS) Mkdir(name string, perm fs.FileMode) error {
+	if err := a.mem.Mkdir(name, perm); err != nil {
+		return err
+	}
+	return a.write(name, "", nil)
+}
+
+func (a *ArchiveFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	if _, err := a.mem.Lstat(name); err == nil {
+		return a.modified("open", name)
+	}
+	if err := a.mem.WriteFile(name, data, perm); err != nil {
+		return err
+	}
+	return a.write(name, "", data)
+}
+
+func (a *ArchiveFS) Link(oldname, newname string) error {
+	if err := a.mem.Link(oldname, newname); err != nil {
+		return err
+	}
+	if a.zw != nil {
+		data, err := a.mem.ReadFile(newname)
+		if err != nil {
+			return err
+		}
+		return a.write(newname, "", data)
+	}
+	target, ok := a.rel(oldname)
+	if !ok {
+		return pathError("link", oldname, errors.New("hard link target is outside the archive"))
+	}
+	return a.write(newname, filepath.ToSlash(target), nil)
+}
+
+func (a *ArchiveFS) Symlink(oldname, newname string) error {
+	if err := a.mem.Symlink(oldname, newname); err != nil {
+		return err
+	}
+	return a.write(newname, filepath.ToSlash(a.linkTarget(oldname, newname)), nil)
+}
+
+// rel returns the path of the given entry relative to the root, and whether it
+// is inside the root.
+func (a *ArchiveFS) rel(name string) (string, bool) {
+	rel, ok := a.mem.under(a.root, filepath.Clean(name))
+	if !ok || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// linkTarget returns the target of a symbolic link in the archive. Targets inside
+// the root are made relative to the link so that the archive can be extracted
+// anywhere.
+func (a *ArchiveFS) linkTarget(target, name string) string {
+	t, ok := a.rel(target)
+	if !ok {
+		return target
+	}
+	dir, ok := a.rel(filepath.Dir(name))
+	if !ok {
+		dir = "."
+	}
+	rel, err := filepath.Rel(dir, t)
+	if err != nil {
+		return target
+	}
+	return rel
+}
+
+// write adds the named entry to the archive. For links, target is the target
+// in the archive.
+func (a *ArchiveFS) write(name, target string, data []byte) error {
+	rel, ok := a.rel(name)
+	if !ok {
+		return nil
+	}
+	archiveName := filepath.ToSlash(rel)
+	fi, err := a.mem.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if a.zw != nil {
+		return a.writeZip(archiveName, fi, target, data)
+	}
+	return a.writeTar(archiveName, fi, target, data)
+}
+
+func (a *ArchiveFS) writeTar(name string, fi fs.FileInfo, target string, data []byte) error {
+	hdr, err := tar.FileInfoHeader(fi, target)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	hdr.ModTime = a.ModTime
+	switch {
+	case fi.IsDir():
+		hdr.Name += "/"
+	case fi.Mode()&fs.ModeSymlink == 0 && target != "":
+		hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, target, 0
+	}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeReg {
+		_, err = a.tw.Write(data)
+	}
+	return err
+}
+
+func (a *ArchiveFS) writeZip(name string, fi fs.FileInfo, target string, data []byte) error {
+	hdr, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	hdr.Modified = a.ModTime
+	switch {
+	case fi.IsDir():
+		hdr.Name += "/"
+		hdr.Method = zip.Store
+	case fi.Mode()&fs.ModeSymlink != 0:
+		// Symbolic links are stored as files containing their target.
+		data = []byte(target)
+	}
+	w, err := a.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (a *ArchiveFS) modified(op, name string) error {
+	return pathError(op, name, errArchiveModified)
+}
@@ -0,0 +1,163 @@
+package mktree
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const archiveSource = `
+(dir "a" (@perms 0700)
+	(file "b" (@contents "hello") (@perms 0755)))
+(link "a/b" "c" (@symbolic))
+(link "a/b" "a/d")
+`
+
+func TestInterpreter_ArchiveFile(t *testing.T) {
+	tests := []struct {
+		format ArchiveFormat
+		root   string
+		list   func([]byte) ([]string, error)
+		want   []string
+	}{
+		{
+			format: ArchiveTar,
+			list:   listTar,
+			want: []string{
+				"drwx------ a/",
+				"-rwxr-xr-x a/b hello",
+				"Lrwxrwxrwx c -> a/b",
+				"-rwxr-xr-x a/d => a/b",
+			},
+		},
+		{
+			format: ArchiveTarGzip,
+			root:   "/some/root",
+			list: func(b []byte) ([]string, error) {
+				r, err := gzip.NewReader(bytes.NewReader(b))
+				if err != nil {
+					return nil, err
+				}
+				b, err = ioutil.ReadAll(r)
+				if err != nil {
+					return nil, err
+				}
+				return listTar(b)
+			},
+			want: []string{
+				"drwx------ a/",
+				"-rwxr-xr-x a/b hello",
+				"Lrwxrwxrwx c -> a/b",
+				"-rwxr-xr-x a/d => a/b",
+			},
+		},
+		{
+			format: ArchiveZip,
+			list:   listZip,
+			want: []string{
+				"drwx------ a/",
+				"-rwxr-xr-x a/b hello",
+				"Lrwxrwxrwx c a/b",
+				"-rwxr-xr-x a/d hello",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format.String(), func(t *testing.T) {
+			var b bytes.Buffer
+			i := &Interpreter{Root: tt.root}
+			if err := i.ArchiveFile(&b, tt.format, strings.NewReader(archiveSource), ""); err != nil {
+				t.Fatal(err)
+			}
+			got, err := tt.list(b.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("got unexpected archive entries (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestArchiveFormatFor(t *testing.T) {
+	for name, want := range map[string]ArchiveFormat{
+		"a.tar":    ArchiveTar,
+		"a.tar.gz": ArchiveTarGzip,
+		"a.TGZ":    ArchiveTarGzip,
+		"a.zip":    ArchiveZip,
+	} {
+		got, err := ArchiveFormatFor(name)
+		if err != nil {
+			t.Errorf("ArchiveFormatFor(%q): %v", name, err)
+		} else if got != want {
+			t.Errorf("ArchiveFormatFor(%q) = %v, want %v", name, got, want)
+		}
+	}
+	if _, err := ArchiveFormatFor("a.rar"); err == nil {
+		t.Errorf("ArchiveFormatFor(%q): expected an error but got nil", "a.rar")
+	}
+}
+
+func listTar(b []byte) ([]string, error) {
+	var entries []string
+	r := tar.NewReader(bytes.NewReader(b))
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry := fmt.Sprintf("%v %s", hdr.FileInfo().Mode(), hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeLink:
+			entry += " => " + hdr.Linkname
+		case tar.TypeSymlink:
+			entry += " -> " + hdr.Linkname
+		case tar.TypeReg:
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return nil, err
+			}
+			entry += " " + string(data)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+func listZip(b []byte) ([]string, error) {
+	r, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return nil, err
+	}
+	var entries []string
+	for _, f := range r.File {
+		entry := fmt.Sprintf("%v %s", f.Mode(), f.Name)
+		if f.Mode()&os.ModeDir == 0 {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			data, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+			entry += " " + string(data)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -9,15 +9,17 @@ import (
 	"time"
 )
 
-func builtins(i *Interpreter) []Option {
-	return []Option{
+// builtins returns the builtin template functions and the standard library,
+// whose random functions use the given seed. Var depends on where it is called,
+// so it is added by thread.funcs.
+func builtins(seed int64) []Option {
+	return append(stdlib(seed),
 		WithTemplateFunction("FileExists", newFileExistsBuiltin()),
 		WithTemplateFunction("FileContents", newFileContentsBuiltin()),
 		WithTemplateFunction("Now", newNowBuiltin()),
 		WithTemplateFunction("Year", newYearBuiltin()),
 		WithTemplateFunction("User", newUserBuiltin()),
-		WithTemplateFunction("Var", newVarBuiltin(i.Vars)),
-	}
+	)
 }
 
 func newFileContentsBuiltin() func(string) (string, error) {
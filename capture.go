@@ -0,0 +1,239 @@
+package mktree
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/kendalharland/mktree/parse"
+)
+
+// DefaultMaxInlineSize is the default value of CaptureOptions.MaxInlineSize.
+const DefaultMaxInlineSize = 4096
+
+// CaptureOptions configures CaptureDir.
+type CaptureOptions struct {
+	// MaxInlineSize is the size in bytes of the largest text file whose contents
+	// are written inline with @contents. Larger files and binary files are
+	// extracted into templates. It defaults to DefaultMaxInlineSize.
+	MaxInlineSize int
+
+	// TemplateDir is the slash-separated directory that templates are extracted
+	// to, relative to the source file. It defaults to "templates".
+	TemplateDir string
+}
+
+// Capture is mktree source that recreates an existing directory.
+type Capture struct {
+	// Source is the formatted mktree source.
+	Source []byte
+
+	// Templates maps the slash-separated path of each template referred to by
+	// Source, relative to the source file, to its contents.
+	Templates map[string][]byte
+
+	// Skipped lists the entries that mktree cannot create, such as sockets and
+	// devices, relative to the captured directory.
+	Skipped []string
+}
+
+// CaptureDir walks the directory root and returns source that recreates its
+// contents: a dir, file or link entity for each entry, with its permissions
+// if they differ from the defaults. Symbolic links keep their targets and files
+// that are hard links to a file captured earlier become hard links.
+func CaptureDir(root string, opts *CaptureOptions) (*Capture, error) {
+	cp := &capturer{
+		root:          root,
+		maxInlineSize: DefaultMaxInlineSize,
+		templateDir:   "templates",
+		files:         map[int64][]capturedFile{},
+		capture:       &Capture{Templates: map[string][]byte{}},
+	}
+	if opts != nil && opts.MaxInlineSize > 0 {
+		cp.maxInlineSize = opts.MaxInlineSize
+	}
+	if opts != nil && opts.TemplateDir != "" {
+		cp.templateDir = opts.TemplateDir
+	}
+
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+
+	sexprs, err := cp.captureDir(".")
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := parse.Fprint(&b, &parse.Tree{SExprs: sexprs}); err != nil {
+		return nil, err
+	}
+	cp.capture.Source = b.Bytes()
+	return cp.capture, nil
+}
+
+type capturer struct {
+	root          string
+	maxInlineSize int
+	templateDir   string
+	capture       *Capture
+
+	// The regular files captured so far, by size, used to find hard links.
+	files map[int64][]capturedFile
+}
+
+type capturedFile struct {
+	name string
+	stat os.FileInfo
+}
+
+// captureDir returns the entities for the children of the directory named dir,
+// relative to the root.
+//
+// Subdirectories are captured before the other entries, the same order in which
+// a plan creates them, so that a hard link always refers to a file that exists by
+// the time the link is created.
+func (cp *capturer) captureDir(dir string) ([]*parse.SExpr, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(cp.root, dir))
+	if err != nil {
+		return nil, err
+	}
+
+	captured := make([]*parse.SExpr, len(entries))
+	for _, dirs := range []bool{true, false} {
+		for i, stat := range entries {
+			if stat.IsDir() != dirs {
+				continue
+			}
+			name := filepath.Join(dir, stat.Name())
+			switch mode := stat.Mode(); {
+			case mode.IsDir():
+				captured[i], err = cp.captureSubdir(name, stat)
+			case mode.IsRegular():
+				captured[i], err = cp.captureFile(name, stat)
+			case mode&os.ModeSymlink != 0:
+				captured[i], err = cp.captureSymlink(name)
+			default:
+				cp.capture.Skipped = append(cp.capture.Skipped, name)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var sexprs []*parse.SExpr
+	for _, e := range captured {
+		if e != nil {
+			sexprs = append(sexprs, e)
+		}
+	}
+	return sexprs, nil
+}
+
+func (cp *capturer) captureSubdir(name string, stat os.FileInfo) (*parse.SExpr, error) {
+	children, err := cp.captureDir(name)
+	if err != nil {
+		return nil, err
+	}
+	e := captureSExpr(parse.DirTokenKind, captureString(filepath.Base(name)))
+	if stat.Mode().Perm() != defaultDirMode.Perm() {
+		e.Args = append(e.Args, capturePerms(stat.Mode()))
+	}
+	for _, child := range children {
+		e.Args = append(e.Args, &parse.Arg{Token: child.Literal.Token, SExpr: child})
+	}
+	return e, nil
+}
+
+func (cp *capturer) captureFile(name string, stat os.FileInfo) (*parse.SExpr, error) {
+	base := filepath.Base(name)
+	for _, f := range cp.files[stat.Size()] {
+		if os.SameFile(f.stat, stat) {
+			target, err := filepath.Rel(filepath.Dir(name), f.name)
+			if err != nil {
+				return nil, err
+			}
+			return captureSExpr(parse.LinkTokenKind, captureString(target), captureString(base)), nil
+		}
+	}
+	cp.files[stat.Size()] = append(cp.files[stat.Size()], capturedFile{name: name, stat: stat})
+
+	data, err := ioutil.ReadFile(filepath.Join(cp.root, name))
+	if err != nil {
+		return nil, err
+	}
+	e := captureSExpr(parse.FileTokenKind, captureString(base))
+	switch {
+	case len(data) == 0:
+	case len(data) <= cp.maxInlineSize && isText(data):
+		e.Args = append(e.Args, captureAttr("contents", captureString(string(data))))
+	default:
+		template := path.Join(cp.templateDir, filepath.ToSlash(name))
+		cp.capture.Templates[template] = escapeTemplate(data)
+		e.Args = append(e.Args, captureAttr("template", captureString(template)))
+	}
+	if stat.Mode().Perm() != defaultFileMode.Perm() {
+		e.Args = append(e.Args, capturePerms(stat.Mode()))
+	}
+	return e, nil
+}
+
+func (cp *capturer) captureSymlink(name string) (*parse.SExpr, error) {
+	target, err := os.Readlink(filepath.Join(cp.root, name))
+	if err != nil {
+		return nil, err
+	}
+	return captureSExpr(parse.LinkTokenKind,
+		captureString(target),
+		captureString(filepath.Base(name)),
+		captureAttr("symbolic"),
+	), nil
+}
+
+func captureSExpr(kind parse.TokenKind, args ...*parse.Arg) *parse.SExpr {
+	return &parse.SExpr{
+		Literal: &parse.Literal{Token: &parse.Token{Kind: kind, Value: string(kind)}},
+		Args:    args,
+	}
+}
+
+func captureAttr(name string, args ...*parse.Arg) *parse.Arg {
+	e := &parse.SExpr{
+		Literal: &parse.Literal{Token: &parse.Token{Kind: parse.AttributeTokenKind, Value: "@" + name}},
+		Args:    args,
+	}
+	return &parse.Arg{Token: e.Literal.Token, SExpr: e}
+}
+
+// captureString returns a string argument that evaluates to s. Strings with
+// more than one line are written as raw strings where possible.
+func captureString(s string) *parse.Arg {
+	s = parse.EscapeReferences(s)
+	t := &parse.Token{Kind: parse.StringTokenKind, Value: s, Raw: strings.Contains(strings.TrimSuffix(s, "\n"), "\n")}
+	return &parse.Arg{Token: t, Literal: &parse.Literal{Token: t}}
+}
+
+func capturePerms(mode os.FileMode) *parse.Arg {
+	t := &parse.Token{Kind: parse.NumberTokenKind, Value: fmt.Sprintf("%04o", uint32(mode.Perm()))}
+	return captureAttr("perms", &parse.Arg{Token: t, Literal: &parse.Literal{Token: t}})
+}
+
+// isText reports whether data looks like text that can be written in a string.
+func isText(data []byte) bool {
+	return utf8.Valid(data) && bytes.IndexByte(data, 0) < 0
+}
+
+// escapeTemplate returns a template that renders as data.
+func escapeTemplate(data []byte) []byte {
+	return bytes.ReplaceAll(data, []byte("{{"), []byte(`{{"{{"}}`))
+}
@@ -0,0 +1,105 @@
+package mktree
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"text/template"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCaptureDir(t *testing.T) {
+	src := tempDir(t)
+	if err := os.Mkdir(filepath.Join(src, "a"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(src, "a"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFiles(src, map[string]string{
+		"a/b":   "one\ntwo\n",
+		"c":     "hello",
+		"d":     "{{ not a template }}",
+		"e":     "%(not_a_var)",
+		"empty": "",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "bin"), []byte{0, 1, 2}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(src, "bin"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(src, "a/b"), filepath.Join(src, "h")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("b", filepath.Join(src, "a/s")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := CaptureDir(src, &CaptureOptions{TemplateDir: "t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantSource := `(dir "a"
+    (@perms 0700)
+    (file "b" (@contents """
+        one
+        two
+        """))
+    (link "b" "s" (@symbolic)))
+(file "bin" (@template "t/bin") (@perms 0600))
+(file "c"   (@contents "hello"))
+(file "d"   (@contents "{{ not a template }}"))
+(file "e"   (@contents "%%(not_a_var)"))
+(file "empty")
+(link "a/b" "h")
+`
+	if diff := cmp.Diff(wantSource, string(got.Source)); diff != "" {
+		t.Errorf("got unexpected source (-want,+got):\n%s", diff)
+	}
+	wantTemplates := map[string][]byte{
+		"t/bin": {0, 1, 2},
+	}
+	if diff := cmp.Diff(wantTemplates, got.Templates); diff != "" {
+		t.Errorf("got unexpected templates (-want,+got):\n%s", diff)
+	}
+
+	// The source recreates the directory.
+	out := tempDir(t)
+	for name, data := range got.Templates {
+		filename := filepath.Join(out, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := filepath.Join(out, "root")
+	i := &Interpreter{Root: root}
+	if err := i.ExecFile(bytes.NewReader(got.Source), filepath.Join(out, "src.tree")); err != nil {
+		t.Fatal(err)
+	}
+	assertDir(t, OSFS{}, filepath.Join(root, "a"), 0700|os.ModeDir)
+	assertFile(t, OSFS{}, filepath.Join(root, "bin"), 0600, "\x00\x01\x02")
+	assertFile(t, OSFS{}, filepath.Join(root, "e"), defaultFileMode, "%(not_a_var)")
+	assertLink(t, OSFS{}, filepath.Join(root, "a/b"), filepath.Join(root, "a/s"))
+	assertLink(t, OSFS{}, filepath.Join(root, "a/b"), filepath.Join(root, "h"))
+}
+
+func TestEscapeTemplate(t *testing.T) {
+	data := []byte("{{ .Vars }} {{{ }}")
+	var b bytes.Buffer
+	if err := template.Must(template.New("").Parse(string(escapeTemplate(data)))).Execute(&b, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.String(); got != string(data) {
+		t.Errorf("got %q, want %q", got, data)
+	}
+}
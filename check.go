@@ -0,0 +1,76 @@
+package mktree
+
+import (
+	"fmt"
+	"io"
+)
+
+// The kinds of Problem.
+const (
+	// ProblemMissing means the entry does not exist.
+	ProblemMissing = "missing"
+	// ProblemKind means the entry is a different kind than the tree declares, or
+	// is not a hard link to the declared target.
+	ProblemKind = "kind"
+	// ProblemMode means the entry's mode differs.
+	ProblemMode = "mode"
+	// ProblemContents means the contents of a file differ.
+	ProblemContents = "contents"
+	// ProblemTarget means the target of a symbolic link differs.
+	ProblemTarget = "target"
+	// ProblemUnreadable means the entry could not be read.
+	ProblemUnreadable = "unreadable"
+)
+
+// Problem is a way in which the filesystem does not match a tree.
+type Problem struct {
+	Path    string `json:"path"`
+	Kind    string `json:"kind"`    // The kind of entry the tree declares: "dir", "file" or "link".
+	Problem string `json:"problem"` // One of the Problem constants.
+	Message string `json:"message"`
+
+	// Diff is the unified diff between the existing and expected contents, if
+	// the contents of a file differ.
+	Diff string `json:"diff,omitempty"`
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s %s: %s", p.Kind, p.Path, p.Message)
+}
+
+// CheckFile interprets the given file and returns the ways in which the
+// filesystem does not match the tree, without changing anything. The arguments
+// are the same as for ExecFile.
+func (i *Interpreter) CheckFile(r io.Reader, filename string, opts ...Option) ([]Problem, error) {
+	p, err := i.PlanFile(r, filename, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return p.Problems(), nil
+}
+
+// Problems returns the ways in which the filesystem does not match the tree.
+// Entries that are skipped because of their ExistsPolicy must exist and be of
+// the declared kind, but their mode, contents and target are not compared.
+func (p *Plan) Problems() []Problem {
+	var problems []Problem
+	for _, c := range p.Changes {
+		switch {
+		case c.Action == ActionUnchanged:
+			continue
+		case c.Action == ActionCreate || c.missing:
+			problems = append(problems, Problem{Path: c.Path, Kind: c.Kind, Problem: ProblemMissing, Message: "does not exist"})
+			continue
+		}
+		for _, problem := range c.problems {
+			switch {
+			case c.Action == ActionSkip && problem.Problem != ProblemKind:
+				continue
+			case problem.Problem == ProblemContents:
+				problem.Diff = c.Diff
+			}
+			problems = append(problems, problem)
+		}
+	}
+	return problems
+}
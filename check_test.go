@@ -0,0 +1,98 @@
+package mktree
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestInterpreter_CheckFile(t *testing.T) {
+	root := tempDir(t)
+	if err := os.Mkdir(filepath.Join(root, "d"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFiles(root, map[string]string{
+		"a":    "hello",
+		"b":    "old",
+		"c":    "",
+		"keep": "anything",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("x", filepath.Join(root, "s")); err != nil {
+		t.Fatal(err)
+	}
+
+	source := `
+(file "a" (@contents "hello"))
+(file "b" (@contents "new") (@perms 0600))
+(dir "c")
+(dir "d" (@perms 0700) (file "e"))
+(link "a" "s" (@symbolic))
+(link "a" "h")
+(file "keep" (@exists "skip"))
+`
+	i := &Interpreter{Root: root}
+	got, err := i.CheckFile(strings.NewReader(source), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rel := func(name string) string { return filepath.Join(root, name) }
+	want := []Problem{
+		{Path: rel("c"), Kind: "dir", Problem: ProblemKind, Message: "exists and is not a directory"},
+		{Path: rel("d/e"), Kind: "file", Problem: ProblemMissing, Message: "does not exist"},
+		{Path: rel("b"), Kind: "file", Problem: ProblemMode, Message: "mode -rw-rw-rw- -> -rw-------"},
+		{Path: rel("b"), Kind: "file", Problem: ProblemContents, Message: "contents differ"},
+		{Path: rel("s"), Kind: "link", Problem: ProblemTarget, Message: "target x -> " + rel("a")},
+		{Path: rel("h"), Kind: "link", Problem: ProblemMissing, Message: "does not exist"},
+	}
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(Problem{}, "Diff")); diff != "" {
+		t.Errorf("got unexpected problems (-want,+got):\n%s", diff)
+	}
+	if got[3].Diff == "" {
+		t.Errorf("expected a diff for %v", got[3])
+	}
+
+	// Nothing was changed.
+	if _, err := os.Lstat(rel("h")); !os.IsNotExist(err) {
+		t.Errorf("CheckFile created %s", rel("h"))
+	}
+}
+
+func TestInterpreter_CheckFileSkip(t *testing.T) {
+	root := tempDir(t)
+	if err := os.Mkdir(filepath.Join(root, "d"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFiles(root, map[string]string{"keep": "anything", "f": ""}); err != nil {
+		t.Fatal(err)
+	}
+
+	source := `
+(file "keep" (@exists "skip") (@contents "hello") (@perms 0600))
+(dir "f" (@exists "skip") (file "g"))
+(file "d" (@exists "skip"))
+(file "new" (@exists "skip"))
+`
+	i := &Interpreter{Root: root}
+	got, err := i.CheckFile(strings.NewReader(source), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rel := func(name string) string { return filepath.Join(root, name) }
+	want := []Problem{
+		{Path: rel("f"), Kind: "dir", Problem: ProblemKind, Message: "exists and is not a directory"},
+		{Path: rel("f/g"), Kind: "file", Problem: ProblemMissing, Message: "does not exist"},
+		{Path: rel("d"), Kind: "file", Problem: ProblemKind, Message: "exists and is not a regular file"},
+		{Path: rel("new"), Kind: "file", Problem: ProblemMissing, Message: "does not exist"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("got unexpected problems (-want,+got):\n%s", diff)
+	}
+}
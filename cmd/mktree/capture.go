@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/kendalharland/mktree"
+)
+
+var cmdCapture = &command{
+	name:      "capture",
+	usageLine: "capture [-o=<source-file>] [-templates=<dir>] [-max-inline=<bytes>] <dir>",
+	shortDesc: "Write source that recreates an existing directory",
+	flags: func(fs *flag.FlagSet) func([]string) error {
+		c := &captureCommand{}
+		fs.StringVar(&c.output, "o", "", "Write the source to this file instead of stdout. Templates are written relative to it")
+		fs.StringVar(&c.opts.TemplateDir, "templates", "templates", "The directory to extract large and binary files to, relative to the source file")
+		fs.IntVar(&c.opts.MaxInlineSize, "max-inline", mktree.DefaultMaxInlineSize, "The size in bytes of the largest text file written inline with @contents")
+		return c.run
+	},
+}
+
+type captureCommand struct {
+	output string
+	opts   mktree.CaptureOptions
+}
+
+func (c *captureCommand) run(args []string) error {
+	if len(args) != 1 {
+		return errors.New("expected a single directory")
+	}
+
+	capture, err := mktree.CaptureDir(args[0], &c.opts)
+	if err != nil {
+		return err
+	}
+	for _, name := range capture.Skipped {
+		fmt.Fprintf(os.Stderr, "skipping %s: not a directory, regular file or link\n", name)
+	}
+
+	dir := "."
+	if c.output != "" {
+		dir = filepath.Dir(c.output)
+	}
+	for name, data := range capture.Templates {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filename, data, 0666); err != nil {
+			return err
+		}
+	}
+
+	if c.output == "" {
+		_, err := os.Stdout.Write(capture.Source)
+		return err
+	}
+	return ioutil.WriteFile(c.output, capture.Source, 0666)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kendalharland/mktree"
+)
+
+// Exit codes for the check command.
+const (
+	checkExitProblems = 1 // The filesystem does not match the tree.
+	checkExitError    = 2 // The tree could not be checked.
+)
+
+var cmdCheck = &command{
+	name:      "check",
+	usageLine: "check [-root=<dir>] [-json] [-exists=<policy>] [-transactional] [-no-input] [-allow-undefined-vars] [-vars=<name>=<value>] [-vars-file=<file>] [-template-path=<dir>] [-partials=<dir>] [-seed=<n>] <source-file>",
+	shortDesc: "Check that the filesystem matches a source file without changing it",
+	flags: func(fs *flag.FlagSet) func([]string) error {
+		c := &checkCommand{}
+		c.interp.register(fs)
+		fs.BoolVar(&c.json, "json", false, "Print the report as JSON")
+		return c.run
+	},
+}
+
+type checkCommand struct {
+	interp interpreterFlags
+	json   bool
+}
+
+// checkReport is the JSON report printed by the check command.
+type checkReport struct {
+	Source   string           `json:"source"`
+	Root     string           `json:"root"`
+	OK       bool             `json:"ok"`
+	Problems []mktree.Problem `json:"problems"`
+}
+
+func (c *checkCommand) run(args []string) error {
+	if len(args) != 1 {
+		return &exitError{code: checkExitError, err: errors.New("expected exactly one source file")}
+	}
+
+	problems, err := c.interp.interpreter().CheckFile(nil, args[0])
+	if err != nil {
+		return &exitError{code: checkExitError, err: err}
+	}
+
+	if c.json {
+		report := &checkReport{
+			Source:   args[0],
+			Root:     c.interp.root,
+			OK:       len(problems) == 0,
+			Problems: append([]mktree.Problem{}, problems...),
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(report); err != nil {
+			return &exitError{code: checkExitError, err: err}
+		}
+	} else {
+		for _, p := range problems {
+			fmt.Println(p)
+			if p.Diff != "" {
+				for _, line := range strings.SplitAfter(strings.TrimSuffix(p.Diff, "\n"), "\n") {
+					fmt.Print("    ", line)
+				}
+				fmt.Println()
+			}
+		}
+		if len(problems) == 0 {
+			fmt.Printf("%s matches %s\n", c.interp.root, args[0])
+		} else {
+			fmt.Printf("%d problems\n", len(problems))
+		}
+	}
+
+	if len(problems) > 0 {
+		return &exitError{code: checkExitProblems}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// command is a mktree subcommand, invoked as "mktree <name> [arguments]".
+type command struct {
+	name      string
+	usageLine string
+	shortDesc string
+
+	// flags returns the command's flag set, bound to the returned run function.
+	flags func(fs *flag.FlagSet) func(args []string) error
+}
+
+var commands = []*command{
+	cmdPlan,
+	cmdApply,
+	cmdCheck,
+	cmdVars,
+	cmdCapture,
+	cmdFmt,
+	cmdLSP,
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (c *command) run(args []string) error {
+	fs := flag.NewFlagSet(c.name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: mktree %s\n\n%s\n\n", c.usageLine, c.shortDesc)
+		fs.PrintDefaults()
+	}
+	run := c.flags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return run(fs.Args())
+}
+
+func commandsUsage() string {
+	var b strings.Builder
+	for _, c := range commands {
+		fmt.Fprintf(&b, "   %-10s %s\n", c.name, c.shortDesc)
+	}
+	return b.String()
+}
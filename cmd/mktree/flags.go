@@ -41,11 +41,11 @@ type keyValueFlag struct {
 
 func (f *keyValueFlag) Set(value string) error {
 	kv := strings.SplitN(value, "=", 2)
-	if len(kv) < 2 || len(kv[0]) == 0 {
-		return errors.New("key-value pair must not be empty")
+	if len(kv) < 2 {
+		return errors.New("missing '=' in key-value pair")
 	}
-	if len(kv[1]) == 0 {
-		return errors.New("missing value in key-value pair")
+	if len(kv[0]) == 0 {
+		return errors.New("missing key in key-value pair")
 	}
 	f.K = kv[0]
 	f.V = kv[1]
@@ -55,3 +55,15 @@ func (f *keyValueFlag) Set(value string) error {
 func (f *keyValueFlag) String() string {
 	return fmt.Sprintf("%s=%v", f.K, f.V)
 }
+
+// stringsFlag is a flag that can be repeated to give a list of values.
+type stringsFlag []string
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func (f *stringsFlag) String() string {
+	return "[" + strings.Join(*f, ",") + "]"
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/kendalharland/mktree/internal/diff"
+	"github.com/kendalharland/mktree/parse"
+)
+
+var cmdFmt = &command{
+	name:      "fmt",
+	usageLine: "fmt [-w] [-d] [<source-file>...]",
+	shortDesc: "Reformat source files in canonical style",
+	flags: func(fs *flag.FlagSet) func([]string) error {
+		c := &fmtCommand{}
+		fs.BoolVar(&c.write, "w", false, "Write the result to the source file instead of stdout")
+		fs.BoolVar(&c.diff, "d", false, "Print a diff instead of the reformatted source")
+		return c.run
+	},
+}
+
+type fmtCommand struct {
+	write bool
+	diff  bool
+}
+
+func (c *fmtCommand) run(args []string) error {
+	if len(args) == 0 {
+		if c.write {
+			return errors.New("cannot use -w with standard input")
+		}
+		src, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		return c.format(src, "<standard input>")
+	}
+
+	var failed bool
+	for _, filename := range args {
+		src, err := ioutil.ReadFile(filename)
+		if err == nil {
+			err = c.format(src, filename)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+		}
+	}
+	if failed {
+		return errors.New("some files could not be formatted")
+	}
+	return nil
+}
+
+func (c *fmtCommand) format(src []byte, filename string) error {
+	p := &parse.Parser{Filename: filename}
+	tree, err := p.Parse(bytes.NewReader(src))
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	if err := parse.Fprint(&b, tree); err != nil {
+		return err
+	}
+	out := b.Bytes()
+
+	if c.diff {
+		os.Stdout.WriteString(diff.Unified(filename+".orig", filename, string(src), string(out)))
+	}
+	if c.write {
+		if bytes.Equal(src, out) {
+			return nil
+		}
+		stat, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filename, out, stat.Mode().Perm())
+	}
+	if !c.diff {
+		_, err := os.Stdout.Write(out)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/kendalharland/mktree/lsp"
+)
+
+var cmdLSP = &command{
+	name:      "lsp",
+	usageLine: "lsp [-vars=<name>=<value>] [-template-path=<dir>]",
+	shortDesc: "Run a language server over stdin and stdout",
+	flags: func(fs *flag.FlagSet) func([]string) error {
+		c := &lspCommand{vars: &variablesFlag{}}
+		fs.Var(c.vars, "vars", "A list of key-value pairs to use when checking source files")
+		fs.Var(&c.templatePath, "template-path", "A directory to search for templates that are not found next to the source file. May be repeated")
+		return c.run
+	},
+}
+
+type lspCommand struct {
+	vars         flag.Getter
+	templatePath stringsFlag
+}
+
+func (c *lspCommand) run(_ []string) error {
+	s := &lsp.Server{Vars: c.vars.Get().(map[string]string), TemplatePath: c.templatePath}
+	return s.Serve(os.Stdin, os.Stdout)
+}
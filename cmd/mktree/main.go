@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -16,41 +17,65 @@ import (
 
 const helpext = `
 usage: mktree [-debug] [-version] [-allow-undefined-vars]
-              [-vars=<name>=<value>]
-              <source-file>
+              [-exists=<policy>] [-transactional] [-no-input]
+              [-vars=<name>=<value>] [-vars-file=<file>] [-o=<archive>]
+              [-template-path=<dir>] [-partials=<dir>] [-seed=<n>] <source-file>
+       mktree <command> [arguments]
 `
 
 func parseFlags() *options {
 	flag.Usage = usage
 
-	o := &options{vars: &variablesFlag{}}
-	flag.StringVar(&o.root, "root", ".", "Where to create the tree")
+	o := &options{}
+	o.interp.register(flag.CommandLine)
 	flag.BoolVar(&o.debug, "debug", false, "Print the results without creating any files or directories")
 	flag.BoolVar(&o.version, "version", false, "Print the version and exit")
-	flag.BoolVar(&o.allowUndefinedVars, "allow-undefined-vars", false, "Allow undefined variables in the input")
-	flag.Var(o.vars, "vars", "A list of key-value pairs to substitute in the source while preprocessing")
+	flag.StringVar(&o.output, "o", "", "Write the tree to an archive ending in .tar, .tar.gz, .tgz or .zip instead of creating it")
 	flag.Parse()
 	return o
 }
 
 type options struct {
-	root               string
-	debug              bool
-	version            bool
-	allowUndefinedVars bool
-	vars               flag.Getter
+	interp  interpreterFlags
+	debug   bool
+	version bool
+	output  string
 }
 
 func main() {
 	if err := execute(context.TODO()); err != nil {
+		var e *exitError
+		if errors.As(err, &e) {
+			if e.err != nil {
+				log.Print(e.err)
+			}
+			os.Exit(e.code)
+		}
 		log.Fatal(err)
 	}
 }
 
+// exitError is returned by a command to exit with a specific status code. The
+// command has already reported the problem unless err is set.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	if e.err != nil {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
 func usage() {
 	fmt.Println(strings.TrimSpace(helpext))
 	fmt.Println()
 	flag.PrintDefaults()
+	fmt.Println()
+	fmt.Println("COMMANDS:")
+	fmt.Print(commandsUsage())
 }
 
 func printVersion() {
@@ -60,6 +85,12 @@ func printVersion() {
 }
 
 func execute(_ context.Context) error {
+	if len(os.Args) > 1 {
+		if c := findCommand(os.Args[1]); c != nil {
+			return c.run(os.Args[2:])
+		}
+	}
+
 	o := parseFlags()
 
 	if o.version {
@@ -72,11 +103,7 @@ func execute(_ context.Context) error {
 		return nil
 	}
 
-	i := &mktree.Interpreter{
-		Vars:               o.vars.Get().(map[string]string),
-		Root:               o.root,
-		AllowUndefinedVars: o.allowUndefinedVars,
-	}
+	i := o.interp.interpreter()
 
 	filename := flag.Arg(0)
 
@@ -89,5 +116,26 @@ func execute(_ context.Context) error {
 		return nil
 	}
 
+	if o.output != "" {
+		return writeArchive(i, o.output, filename)
+	}
+
 	return i.ExecFile(nil, filename)
 }
+
+func writeArchive(i *mktree.Interpreter, output, filename string) error {
+	format, err := mktree.ArchiveFormatFor(output)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	if err := i.ArchiveFile(f, format, nil, filename); err != nil {
+		f.Close()
+		os.Remove(output)
+		return err
+	}
+	return f.Close()
+}
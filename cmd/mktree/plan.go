@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+
+	"github.com/kendalharland/mktree"
+)
+
+var cmdPlan = &command{
+	name:      "plan",
+	usageLine: "plan [-root=<dir>] [-exists=<policy>] [-transactional] [-no-input] [-allow-undefined-vars] [-vars=<name>=<value>] [-vars-file=<file>] [-template-path=<dir>] [-partials=<dir>] [-seed=<n>] <source-file>",
+	shortDesc: "Show the changes needed to make the filesystem match a source file",
+	flags: func(fs *flag.FlagSet) func([]string) error {
+		c := &planCommand{}
+		c.interp.register(fs)
+		return c.run
+	},
+}
+
+var cmdApply = &command{
+	name:      "apply",
+	usageLine: "apply [-root=<dir>] [-exists=<policy>] [-transactional] [-no-input] [-allow-undefined-vars] [-vars=<name>=<value>] [-vars-file=<file>] [-template-path=<dir>] [-partials=<dir>] [-seed=<n>] <source-file>",
+	shortDesc: "Make the changes shown by plan",
+	flags: func(fs *flag.FlagSet) func([]string) error {
+		c := &planCommand{apply: true}
+		c.interp.register(fs)
+		return c.run
+	},
+}
+
+// interpreterFlags are the flags used to configure a mktree.Interpreter.
+type interpreterFlags struct {
+	root               string
+	allowUndefinedVars bool
+	vars               flag.Getter
+	varsFiles          stringsFlag
+	templatePath       stringsFlag
+	partials           stringsFlag
+	seed               int64
+	exists             mktree.ExistsPolicy
+	transactional      bool
+	noInput            bool
+}
+
+func (f *interpreterFlags) register(fs *flag.FlagSet) {
+	f.vars = &variablesFlag{}
+	fs.StringVar(&f.root, "root", ".", "Where to create the tree")
+	fs.BoolVar(&f.allowUndefinedVars, "allow-undefined-vars", false, "Allow undefined variables in the input")
+	fs.Var(f.vars, "vars", "A list of key-value pairs to interpolate in the source")
+	fs.Var(&f.varsFiles, "vars-file", "A JSON, YAML, TOML or .env file of variables. May be repeated; later files and -vars take precedence")
+	fs.Var(&f.templatePath, "template-path", "A directory to search for templates that are not found next to the source file. May be repeated")
+	fs.Var(&f.partials, "partials", "A directory of templates that every template can use. May be repeated. Defaults to the partials directory next to the source file")
+	fs.Int64Var(&f.seed, "seed", 0, "Seed the random template functions so that they return the same values each time")
+	fs.BoolVar(&f.transactional, "transactional", false, "Undo every change if any change fails")
+	fs.BoolVar(&f.noInput, "no-input", false, "Never prompt for variables that are not set. Prompting is enabled when stdin is a terminal")
+	fs.Func("exists", "What to do with existing entries that differ from the tree: skip, overwrite, error or backup", func(s string) (err error) {
+		f.exists, err = mktree.ParseExistsPolicy(s)
+		return err
+	})
+}
+
+func (f *interpreterFlags) interpreter() *mktree.Interpreter {
+	i := &mktree.Interpreter{
+		Vars:               f.vars.Get().(map[string]string),
+		VarsFiles:          f.varsFiles,
+		TemplatePath:       f.templatePath,
+		TemplatePartials:   f.partials,
+		Seed:               f.seed,
+		Root:               f.root,
+		AllowUndefinedVars: f.allowUndefinedVars,
+		Exists:             f.exists,
+		Transactional:      f.transactional,
+	}
+	if !f.noInput && isTerminal(os.Stdin) {
+		i.Prompt = mktree.LinePrompt(os.Stdin, os.Stderr)
+	}
+	return i
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+type planCommand struct {
+	interp interpreterFlags
+	apply  bool
+}
+
+func (c *planCommand) run(args []string) error {
+	if len(args) != 1 {
+		return errors.New("expected exactly one source file")
+	}
+
+	p, err := c.interp.interpreter().PlanFile(nil, args[0])
+	if err != nil {
+		return err
+	}
+	p.Print(os.Stdout)
+	if !c.apply {
+		return nil
+	}
+	return p.Apply()
+}
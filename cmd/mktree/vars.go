@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kendalharland/mktree"
+)
+
+var cmdVars = &command{
+	name:      "vars",
+	usageLine: "vars <source-file>",
+	shortDesc: "List the variables declared in a source file",
+	flags: func(*flag.FlagSet) func([]string) error {
+		return runVars
+	},
+}
+
+func runVars(args []string) error {
+	if len(args) != 1 {
+		return errors.New("expected exactly one source file")
+	}
+
+	i := &mktree.Interpreter{}
+	vars, err := i.VarsFile(nil, args[0])
+	if err != nil {
+		return err
+	}
+	for _, v := range vars {
+		value := "(required)"
+		if v.HasDefault {
+			value = "= " + strconv.Quote(v.Default)
+		}
+		fmt.Printf("%s %s\n", v.Name, value)
+		if v.Doc != "" {
+			fmt.Printf("    %s\n", v.Doc)
+		}
+		if cs := v.Constraints(); len(cs) > 0 {
+			fmt.Printf("    Must be %s.\n", strings.Join(cs, " and "))
+		}
+	}
+	return nil
+}
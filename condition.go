@@ -0,0 +1,234 @@
+package mktree
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strconv"
+	"text/template"
+
+	"github.com/kendalharland/mktree/parse"
+)
+
+//
+// Conditions
+//
+// A condition is a value or a call to a function, such as (eq license "MIT").
+// The functions are the operators below and the template functions.
+//
+
+// evalWhen evaluates the children of a when expression as children of parent if
+// its condition is true, or the children of an unless expression if it is false.
+func evalWhen(sc *scope, parent *dir, e *parse.SExpr) error {
+	kind := e.Literal.Token.Kind
+	if len(e.Args) < 1 {
+		return evalErrorf(e.Literal.Token, codeMissingArgument, "expected a condition")
+	}
+	ok, err := evalCondition(sc, e.Args[0])
+	if err != nil {
+		return err
+	}
+	if ok == (kind == parse.UnlessTokenKind) {
+		return nil
+	}
+	for _, arg := range e.Args[1:] {
+		if arg.SExpr == nil {
+			return evalErrorf(arg.Token, codeInvalidExpression, "unexpected %v in %s", arg.Token.Value, kind)
+		}
+		if err := evalDirChild(sc, parent, arg.SExpr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func evalCondition(sc *scope, a *parse.Arg) (bool, error) {
+	v, err := evalValue(sc, a)
+	if err != nil {
+		return false, err
+	}
+	return isTrue(v), nil
+}
+
+// isTrue reports whether a value is true. A string is false if it is empty or a
+// false boolean such as "false" or "0". Other values are true unless they are
+// the zero value of their type, as in templates.
+func isTrue(v interface{}) bool {
+	if s, ok := v.(string); ok {
+		b, err := strconv.ParseBool(s)
+		return s != "" && (err != nil || b)
+	}
+	truth, _ := template.IsTrue(v)
+	return truth
+}
+
+// evalValue evaluates a string, number, variable or function call.
+func evalValue(sc *scope, a *parse.Arg) (interface{}, error) {
+	switch {
+	case a.SExpr != nil:
+		return evalCall(sc, a.SExpr)
+	case a.Literal.Token.Kind == parse.NumberTokenKind:
+		return evalNumber(sc, a)
+	}
+	return evalString(sc, a)
+}
+
+func evalValues(sc *scope, args []*parse.Arg) ([]interface{}, error) {
+	values := make([]interface{}, len(args))
+	for i, a := range args {
+		v, err := evalValue(sc, a)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+func evalCall(sc *scope, e *parse.SExpr) (interface{}, error) {
+	t := e.Literal.Token
+	if t.Kind != parse.IdentTokenKind {
+		return nil, evalErrorf(t, codeInvalidExpression, "%v is not a function", t)
+	}
+	switch name := t.Value; name {
+	case "and", "or":
+		// Like in templates, stop at the first argument that decides the result.
+		if len(e.Args) < 1 {
+			return nil, evalErrorf(t, codeMissingArgument, "expected one or more conditions")
+		}
+		for _, a := range e.Args {
+			ok, err := evalCondition(sc, a)
+			if err != nil {
+				return nil, err
+			}
+			if ok == (name == "or") {
+				return ok, nil
+			}
+		}
+		return name == "and", nil
+	case "not":
+		if len(e.Args) != 1 {
+			return nil, evalErrorf(t, codeInvalidArgument, "not takes 1 argument but got %d", len(e.Args))
+		}
+		ok, err := evalCondition(sc, e.Args[0])
+		return !ok, err
+	case "eq", "ne":
+		// The first value is compared with each of the others.
+		if len(e.Args) < 2 {
+			return nil, evalErrorf(t, codeMissingArgument, "expected two or more values")
+		}
+		values, err := evalValues(sc, e.Args)
+		if err != nil {
+			return nil, err
+		}
+		eq := false
+		for _, v := range values[1:] {
+			eq = eq || fmt.Sprint(v) == fmt.Sprint(values[0])
+		}
+		return eq == (name == "eq"), nil
+	case "os", "arch":
+		if len(e.Args) != 0 {
+			return nil, evalErrorf(t, codeInvalidArgument, "%s takes no arguments", name)
+		}
+		if name == "os" {
+			return runtime.GOOS, nil
+		}
+		return runtime.GOARCH, nil
+	}
+
+	fn, ok := sc.thr.funcs(sc.vars)[t.Value]
+	if !ok {
+		return nil, evalErrorf(t, codeInvalidExpression, "undefined function %q", t.Value)
+	}
+	args, err := evalValues(sc, e.Args)
+	if err != nil {
+		return nil, err
+	}
+	v, err := callFunc(fn, args)
+	if err != nil {
+		return nil, evalErrorf(t, codeInvalidArgument, "%s: %v", t.Value, err)
+	}
+	return v, nil
+}
+
+// callFunc calls a template function. The arguments must be assignable to its
+// parameters, except that strings are converted to numeric parameters, since
+// numbers and variables are strings. Like in templates, a second result is an
+// error.
+func callFunc(fn interface{}, args []interface{}) (interface{}, error) {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func {
+		return nil, errors.New("not a function")
+	}
+	t := v.Type()
+	n := t.NumIn()
+	switch {
+	case t.IsVariadic() && len(args) < n-1:
+		return nil, fmt.Errorf("takes at least %d arguments but got %d", n-1, len(args))
+	case !t.IsVariadic() && len(args) != n:
+		return nil, fmt.Errorf("takes %d arguments but got %d", n, len(args))
+	}
+	in := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		var want reflect.Type
+		if t.IsVariadic() && i >= n-1 {
+			want = t.In(n - 1).Elem()
+		} else {
+			want = t.In(i)
+		}
+		if arg == nil {
+			in[i] = reflect.Zero(want)
+			continue
+		}
+		in[i] = reflect.ValueOf(arg)
+		if s, ok := arg.(string); ok && !in[i].Type().AssignableTo(want) {
+			var err error
+			if in[i], err = parseNumber(s, want); err != nil {
+				return nil, fmt.Errorf("argument %d: %v", i+1, err)
+			}
+		}
+		if !in[i].Type().AssignableTo(want) {
+			return nil, fmt.Errorf("argument %d must be %v, not %v", i+1, want, in[i].Type())
+		}
+	}
+	out := v.Call(in)
+	if len(out) == 2 {
+		if err, _ := out[1].Interface().(error); err != nil {
+			return nil, err
+		}
+	}
+	if len(out) == 0 {
+		return nil, nil
+	}
+	return out[0].Interface(), nil
+}
+
+// parseNumber converts s to a value of the numeric type t. It returns s
+// unchanged if t is not numeric.
+func parseNumber(s string, t reflect.Type) (reflect.Value, error) {
+	v := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, t.Bits())
+		if err != nil {
+			return v, fmt.Errorf("%q is not an integer", s)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, t.Bits())
+		if err != nil {
+			return v, fmt.Errorf("%q is not an unsigned integer", s)
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, t.Bits())
+		if err != nil {
+			return v, fmt.Errorf("%q is not a number", s)
+		}
+		v.SetFloat(n)
+	default:
+		return reflect.ValueOf(s), nil
+	}
+	return v, nil
+}
@@ -12,6 +12,8 @@ import (
 
 type Tree struct {
 	root *dir
+	vars map[string]string // The value of every variable.
+	thr  *thread
 }
 
 func (t *Tree) DebugPrint(w io.Writer) {
@@ -19,11 +21,13 @@ func (t *Tree) DebugPrint(w io.Writer) {
 }
 
 type dir struct {
-	name  string
-	perms os.FileMode
-	files []*file
-	dirs  []*dir
-	links []*link
+	name     string
+	perms    os.FileMode
+	hasPerms bool // Whether perms was set with @perms.
+	exists   ExistsPolicy
+	files    []*file
+	dirs     []*dir
+	links    []*link
 }
 
 func (d *dir) debugPrint(w io.Writer) {
@@ -62,20 +66,22 @@ func (d *dir) addLink(child *link) {
 	d.links = append(d.links, child)
 }
 
-func (d *dir) setPerms(args []*parse.Arg) error {
-	mode, err := evalFileMode(args[0])
-	if err != nil {
-		return err
-	}
-	d.perms = mode | fs.ModeDir
-	return nil
+func (d *dir) setPerms(perms os.FileMode) {
+	d.perms = perms | fs.ModeDir
+	d.hasPerms = true
 }
 
 type file struct {
 	name         string
 	perms        os.FileMode
+	hasPerms     bool // Whether perms was set with @perms.
+	exists       ExistsPolicy
 	contents     []byte
 	templatePath string
+	templateAt   parse.Diagnostic    // The @template attribute, for template errors.
+	vars         map[string]string   // The variables of the template.
+	lists        map[string][]string // The list variables of the template.
+	data         map[string]interface{}
 }
 
 func (f *file) debugPrint(w io.Writer) {
@@ -84,6 +90,7 @@ func (f *file) debugPrint(w io.Writer) {
 
 func (f *file) setPerms(perms os.FileMode) error {
 	f.perms = perms
+	f.hasPerms = true
 	return nil
 }
 
@@ -107,4 +114,5 @@ type link struct {
 	name     string
 	target   string
 	symbolic bool
+	exists   ExistsPolicy
 }
@@ -1,14 +1,12 @@
 package mktree
 
 import (
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
-	"golang.org/x/sys/unix"
 )
 
 func Example_dir() {
@@ -91,20 +89,19 @@ func interpretVars(source string, vars map[string]string) {
 
 // Executes examples/docs/examples.tree and asserts the output is as expected.
 func TestExamples(t *testing.T) {
-	root, err := ioutil.TempDir("", "mktree")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer os.RemoveAll(root)
+	root := "/root"
+	fsys := &MemFS{}
 
 	i := &Interpreter{
 		Root: root,
 		Vars: map[string]string{"my_var": "test"},
 	}
 	opts := []Option{
+		WithFS(fsys),
 		WithTemplateFunction("FileExists", func(_ string) bool { return false }),
 		WithTemplateFunction("FileContents", func(_ string) string { return "contents" }),
 		WithTemplateFunction("Now", func() string { return "2022-03-01" }),
+		WithTemplateFunction("Year", func() string { return "2022" }),
 		WithTemplateFunction("User", func() string { return "test" }),
 	}
 
@@ -112,11 +109,11 @@ func TestExamples(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	assertDir(t, filepath.Join(root, "example"), defaultDirMode)
-	assertFile(t, filepath.Join(root, "original.txt"), defaultFileMode, "")
-	assertLink(t, filepath.Join(root, "original.txt"), filepath.Join(root, "symbolic.txt"))
-	assertFile(t, filepath.Join(root, "example.txt"), os.FileMode(0667), "")
-	assertFile(t, filepath.Join(root, "template_example.txt"), defaultFileMode, strings.TrimSpace(`
+	assertDir(t, fsys, filepath.Join(root, "example"), defaultDirMode)
+	assertFile(t, fsys, filepath.Join(root, "original.txt"), defaultFileMode, "")
+	assertLink(t, fsys, filepath.Join(root, "original.txt"), filepath.Join(root, "symbolic.txt"))
+	assertFile(t, fsys, filepath.Join(root, "example.txt"), os.FileMode(0667), "")
+	assertFile(t, fsys, filepath.Join(root, "template_example.txt"), defaultFileMode, strings.TrimSpace(`
 [start:now_example]
 The current time is 2022-03-01
 [end:now_example]
@@ -143,27 +140,23 @@ The current year is 2022
 `))
 }
 
-func assertDir(t *testing.T, name string, mode os.FileMode) {
+func assertDir(t *testing.T, fsys FS, name string, mode os.FileMode) {
 	t.Helper()
-	stat, err := os.Stat(name)
+	stat, err := fsys.Stat(name)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if !stat.IsDir() {
 		t.Fatalf("not a directory: %s", name)
 	}
-	umask := unix.Umask(0)
-	defer unix.Umask(umask)
-	// mode = os.FileMode(uint32(umask) ^ uint32(mode))
-	// fmt.Printf("umask=%#o, mode=%#o\n", umask, mode)
 	if mode != stat.Mode() {
 		t.Fatalf("expected dir mode %#o but got %#o", mode, stat.Mode())
 	}
 }
 
-func assertFile(t *testing.T, name string, mode os.FileMode, contents string) {
+func assertFile(t *testing.T, fsys FS, name string, mode os.FileMode, contents string) {
 	t.Helper()
-	stat, err := os.Stat(name)
+	stat, err := fsys.Stat(name)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -173,7 +166,7 @@ func assertFile(t *testing.T, name string, mode os.FileMode, contents string) {
 	if stat.Mode() != mode {
 		t.Fatalf("expected file mode %#o but got %#o", mode, stat.Mode())
 	}
-	got, err := ioutil.ReadFile(name)
+	got, err := fsys.ReadFile(name)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -182,25 +175,26 @@ func assertFile(t *testing.T, name string, mode os.FileMode, contents string) {
 	}
 }
 
-func assertLink(t *testing.T, target, name string) {
+// assertLink asserts that name is a hard or symbolic link to target.
+func assertLink(t *testing.T, fsys FS, target, name string) {
 	t.Helper()
-	stat, err := os.Lstat(name)
+	stat, err := fsys.Lstat(name)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if stat.IsDir() {
 		t.Fatalf("%s is a directory", name)
 	}
-	gotTarget, err := filepath.EvalSymlinks(name)
+	got, err := fsys.Stat(name)
 	if err != nil {
 		t.Fatal(err)
 	}
-	wantTarget, err := filepath.EvalSymlinks(target)
+	want, err := fsys.Stat(target)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if gotTarget != wantTarget {
-		t.Fatalf("got target\n%q\nbut wanted\n%q\n", gotTarget, wantTarget)
+	if !fsys.SameFile(got, want) {
+		t.Fatalf("%q is not a link to %q", name, target)
 	}
 }
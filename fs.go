@@ -0,0 +1,110 @@
+package mktree
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"os"
+)
+
+// FS is a writable filesystem that a Tree is generated into.
+//
+// Paths use the separator of the current platform and are not rooted in the
+// filesystem: the names passed to its methods are the names of the generated
+// entries, which begin with the Interpreter's Root.
+type FS interface {
+	// Lstat returns information about the named entry without following symbolic
+	// links.
+	Lstat(name string) (fs.FileInfo, error)
+
+	// Stat returns information about the named entry, following symbolic links.
+	Stat(name string) (fs.FileInfo, error)
+
+	// SameFile reports whether fi1 and fi2, as returned by this filesystem,
+	// describe the same file.
+	SameFile(fi1, fi2 fs.FileInfo) bool
+
+	// ReadFile returns the contents of the named file.
+	ReadFile(name string) ([]byte, error)
+
+	// Readlink returns the target of the named symbolic link.
+	Readlink(name string) (string, error)
+
+	// Mkdir creates a directory with exactly the given permissions. The parent
+	// directory must exist.
+	Mkdir(name string, perm fs.FileMode) error
+
+	// WriteFile writes data to the named file, creating it if needed, and sets its
+	// permissions to exactly perm.
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+
+	// Chmod changes the permissions of the named entry.
+	Chmod(name string, mode fs.FileMode) error
+
+	// Rename moves oldpath to newpath.
+	Rename(oldpath, newpath string) error
+
+	// Remove removes the named file, link or empty directory.
+	Remove(name string) error
+
+	// RemoveAll removes the named entry and everything it contains.
+	RemoveAll(name string) error
+
+	// Link creates newname as a hard link to oldname.
+	Link(oldname, newname string) error
+
+	// Symlink creates newname as a symbolic link to oldname.
+	Symlink(oldname, newname string) error
+}
+
+// WithFS generates the tree into fsys instead of the operating system's
+// filesystem. Template files are always read from the operating system.
+func WithFS(fsys FS) Option {
+	return &option{
+		applyFunc: func(t *thread) {
+			t.fs = fsys
+		},
+	}
+}
+
+// OSFS is an FS backed by the operating system's filesystem. Unlike the functions
+// in package os, its methods set permissions regardless of the process umask.
+type OSFS struct{}
+
+var _ FS = OSFS{}
+
+func (OSFS) Lstat(name string) (fs.FileInfo, error) { return os.Lstat(name) }
+
+func (OSFS) Stat(name string) (fs.FileInfo, error) { return os.Stat(name) }
+
+func (OSFS) SameFile(fi1, fi2 fs.FileInfo) bool { return os.SameFile(fi1, fi2) }
+
+func (OSFS) ReadFile(name string) ([]byte, error) { return ioutil.ReadFile(name) }
+
+func (OSFS) Readlink(name string) (string, error) { return os.Readlink(name) }
+
+func (OSFS) Mkdir(name string, perm fs.FileMode) error {
+	if err := os.Mkdir(name, perm); err != nil {
+		return err
+	}
+	return os.Chmod(name, perm)
+}
+
+func (OSFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	if err := ioutil.WriteFile(name, data, perm); err != nil {
+		return err
+	}
+	// WriteFile does not change the mode of an existing file.
+	return os.Chmod(name, perm)
+}
+
+func (OSFS) Chmod(name string, mode fs.FileMode) error { return os.Chmod(name, mode) }
+
+func (OSFS) Rename(oldpath, newpath string) error { return os.Rename(oldpath, newpath) }
+
+func (OSFS) Remove(name string) error { return os.Remove(name) }
+
+func (OSFS) RemoveAll(name string) error { return os.RemoveAll(name) }
+
+func (OSFS) Link(oldname, newname string) error { return os.Link(oldname, newname) }
+
+func (OSFS) Symlink(oldname, newname string) error { return os.Symlink(oldname, newname) }
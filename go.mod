@@ -3,11 +3,12 @@ module github.com/kendalharland/mktree
 go 1.17
 
 require (
-	github.com/Masterminds/semver v1.5.0 // indirect
-	github.com/gomarkdown/markdown v0.0.0-20220627144906-e9a81102ebeb // indirect
-	github.com/google/go-cmp v0.5.8 // indirect
-	github.com/maruel/subcommands v1.1.1 // indirect
-	github.com/texttheater/golang-levenshtein v1.0.1 // indirect
-	golang.org/x/mod v0.5.1 // indirect
-	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
+	github.com/BurntSushi/toml v1.2.1
+	github.com/Masterminds/semver v1.5.0
+	github.com/gomarkdown/markdown v0.0.0-20220627144906-e9a81102ebeb
+	github.com/google/go-cmp v0.5.8
+	github.com/maruel/subcommands v1.1.1
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require github.com/texttheater/golang-levenshtein v1.0.1 // indirect
@@ -0,0 +1,91 @@
+package diff
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+		want     string
+	}{
+		{
+			name: "equal",
+			old:  "a\nb\n",
+			new:  "a\nb\n",
+			want: "",
+		},
+		{
+			name: "insert",
+			old:  "a\nc\n",
+			new:  "a\nb\nc\n",
+			want: `
+--- old
++++ new
+@@ -1,2 +1,3 @@
+ a
++b
+ c
+`,
+		},
+		{
+			name: "separate_hunks",
+			old:  "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n",
+			new:  "0\n2\n3\n4\n5\n6\n7\n8\n9\n11\n",
+			want: `
+--- old
++++ new
+@@ -1,4 +1,4 @@
+-1
++0
+ 2
+ 3
+ 4
+@@ -7,4 +7,4 @@
+ 7
+ 8
+ 9
+-10
++11
+`,
+		},
+		{
+			name: "from_empty",
+			old:  "",
+			new:  "a\n",
+			want: `
+--- old
++++ new
+@@ -0,0 +1 @@
++a
+`,
+		},
+		{
+			name: "missing_newline",
+			old:  "a\nb",
+			new:  "a\nb\n",
+			want: `
+--- old
++++ new
+@@ -1,2 +1,2 @@
+ a
+-b
+\ No newline at end of file
++b
+`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := Unified("old", "new", test.old, test.new)
+			want := strings.TrimPrefix(test.want, "\n")
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Fatalf("Unified() got diff (+got,-want):\n%s\n", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package mktree
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kendalharland/mktree/parse"
+)
+
+var errUndefinedVar = errors.New("undefined variable")
+
+// scope is the context in which source is evaluated.
+type scope struct {
+	unit *unit // The file containing the source.
+
+	// vars are the values of the variables that can be referenced. Variables
+	// cannot be referenced if vars is nil.
+	vars               map[string]string
+	lists              map[string][]string // The variables that are lists.
+	allowUndefinedVars bool
+
+	thr *thread // Provides the template functions that can be called.
+
+	fragment *fragment // The fragment being used, if any.
+	parent   *scope    // The scope that used the fragment or included the file.
+}
+
+// constScope is the scope of source that is evaluated before the values of the
+// variables are known, such as var declarations and include paths.
+var constScope = &scope{}
+
+// interpolate returns the value of t with each variable reference replaced by
+// the variable's value. Values are never parsed, so they cannot change the
+// structure of the tree.
+func (sc *scope) interpolate(t *parse.Token) (string, error) {
+	value, err := parse.Interpolate(t.Value, func(name string) (string, error) {
+		return sc.lookup(t, name)
+	})
+	if err != nil {
+		var e *evalError
+		if errors.As(err, &e) {
+			return "", err
+		}
+		return "", evalErrorf(t, codeInvalidArgument, "%v", err)
+	}
+	return value, nil
+}
+
+// lookup returns the value of the named variable, referred to by t.
+func (sc *scope) lookup(t *parse.Token, name string) (string, error) {
+	if sc.vars == nil {
+		return "", evalErrorf(t, codeInvalidArgument, "variables cannot be used here")
+	}
+	value, ok := sc.vars[name]
+	if _, isList := sc.lists[name]; !ok && isList {
+		return "", evalErrorf(t, codeInvalidArgument, "variable %q is a list", name)
+	}
+	if !ok && sc.thr != nil && sc.thr.prompt != nil {
+		return sc.thr.promptVar(name)
+	}
+	if !ok && !sc.allowUndefinedVars {
+		// Use quotes in case the name contains spaces.
+		return "", &evalError{tok: t, kind: errUndefinedVar, code: codeUndefinedVar, msg: fmt.Sprintf("%q", name)}
+	}
+	return value, nil
+}
+
+// root returns the scope of the main source file.
+func (sc *scope) root() *scope {
+	for sc.parent != nil {
+		sc = sc.parent
+	}
+	return sc
+}
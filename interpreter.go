@@ -5,14 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"text/template"
 
 	"github.com/kendalharland/mktree/parse"
-	"golang.org/x/sys/unix"
 )
 
 var errInterpret = errors.New("interpet error")
@@ -27,6 +26,54 @@ type Interpreter struct {
 	Vars               map[string]string
 	Stderr             io.Writer
 	AllowUndefinedVars bool
+
+	// VarsFiles are files to read variables from, in order, before Vars. A
+	// variable in a later file overrides earlier ones, and Vars overrides them
+	// all. See ReadVarsFile for the supported formats.
+	VarsFiles []string
+
+	// Exists is the policy for existing entries that do not match the tree. It
+	// can be overridden for an entry and its children using the @exists attribute.
+	Exists ExistsPolicy
+
+	// Transactional makes ExecFile undo every change it made if any change fails,
+	// instead of leaving a partially generated tree.
+	Transactional bool
+
+	// Prompt, if set, is called to ask for the value of each variable that is
+	// declared in the source but not set in Vars or VarsFiles, including
+	// variables with a default, and of each undeclared variable that is not set
+	// when it is substituted. It is not called if AllowUndefinedVars is set. See
+	// LinePrompt.
+	Prompt func(v *Var) (string, error)
+
+	// TemplatePath are directories to search, in order, for templates that are
+	// not found relative to the source file that names them.
+	TemplatePath []string
+
+	// TemplatePartials are directories of partials: templates that are parsed
+	// with every template, so that they can be used with {{ template "name" }}.
+	// If nil, the partials directory next to the source file is used if it
+	// exists.
+	TemplatePartials []string
+
+	// Seed seeds the random template functions, such as UUID, so that they
+	// return the same values each time. If zero, the current time is used.
+	Seed int64
+}
+
+// FindTemplate returns the path to the template named by a @template attribute
+// in the given source file: the file relative to the source file if it exists,
+// or else the first found in TemplatePath. It returns false if the template is
+// not found.
+func (i *Interpreter) FindTemplate(filename, name string) (string, bool) {
+	thr := newThread(filename)
+	thr.templatePath = i.TemplatePath
+	path := thr.findTemplate(name, name)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(thr.sourceRoot, path)
+	}
+	return path, fileExists(path)
 }
 
 func (i *Interpreter) init() error {
@@ -47,53 +94,75 @@ func (i *Interpreter) init() error {
 // If r is nil, the file is read and executed. Otherwise, the input is read from r
 // and the filename is used only to add context to error messages.
 // If r is nil and the filename is empty, an error is returned.
+// It is equivalent to calling PlanFile and applying the result.
 func (i *Interpreter) ExecFile(r io.Reader, filename string, opts ...Option) error {
-	tree, err := i.InterpretFile(r, filename)
+	p, err := i.PlanFile(r, filename, opts...)
 	if err != nil {
 		return err
 	}
-
-	// append builtin options first so the user can override them.
-	opts = append(builtins(i), opts...)
-	t := newThread(filename, opts...)
-	return createTree(t, tree)
+	return p.Apply()
 }
 
 // InterpretFile interprets the given file.
 // If r is nil, the file is read and interpreted. Otherwise, the input is read from r
 // and the filename is used only to add context to error messages.
 // If r is nil and the filename is empty, an error is returned.
-func (i *Interpreter) InterpretFile(r io.Reader, filename string) (*Tree, error) {
+// The template functions registered by opts can be called in conditions.
+func (i *Interpreter) InterpretFile(r io.Reader, filename string, opts ...Option) (*Tree, error) {
 	i.init()
 
-	if r == nil {
-		if filename == "" {
-			return nil, errors.New("the caller must provide a non-nil reader or the path to a file")
-		}
-		source, err := ioutil.ReadFile(filename)
-		if err != nil {
-			return nil, err
-		}
-		r = bytes.NewReader(source)
+	source, err := readSource(r, filename)
+	if err != nil {
+		return nil, err
 	}
 
-	source, err := preprocess(r, i.Vars, i.AllowUndefinedVars)
+	l := newLoader(i.Stderr)
+	main, err := l.load(filename, ".", source)
+	if err != nil {
+		return nil, err
+	}
+	decls, err := l.vars()
 	if err != nil {
 		return nil, err
 	}
 
-	p := &parse.Parser{Stderr: i.Stderr}
-	tree, err := p.Parse(source)
+	given, givenLists, err := i.givenVars()
 	if err != nil {
 		return nil, err
 	}
+	vars, lists := varValues(decls, given, givenLists)
+	// Nothing is asked for if undefined variables are allowed.
+	prompt := i.Prompt
+	if i.AllowUndefinedVars {
+		prompt = nil
+	}
+	if prompt != nil {
+		isGiven := map[string]bool{}
+		for name := range given {
+			isGiven[name] = true
+		}
+		for name := range givenLists {
+			isGiven[name] = true
+		}
+		if err := i.promptVars(decls, isGiven, vars, lists); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateVars(decls, vars, lists); err != nil {
+		return nil, err
+	}
 
+	// append builtin options first so the user can override them.
+	thr := newThread(filename, append(builtins(i.Seed), opts...)...)
+	thr.templatePath, thr.partialsDirs = i.TemplatePath, i.TemplatePartials
+	thr.prompt = prompt
 	root := defaultRootDir(i.Root)
-	if err := evalTree(tree, root); err != nil {
-		return nil, err
+	sc := &scope{unit: main, vars: vars, lists: lists, allowUndefinedVars: i.AllowUndefinedVars, thr: thr}
+	if err := evalTree(sc, main.tree, root); err != nil {
+		return nil, diagnose(filename, source, err)
 	}
 
-	return &Tree{root}, nil
+	return &Tree{root: root, vars: vars, thr: thr}, nil
 }
 
 func defaultRootDir(name string) *dir {
@@ -103,21 +172,71 @@ func defaultRootDir(name string) *dir {
 	}
 }
 
-func evalTree(t *parse.Tree, root *dir) error {
+func evalTree(sc *scope, t *parse.Tree, root *dir) error {
 	for _, e := range t.SExprs {
-		if err := evalDirChild(root, e); err != nil {
+		switch e.Literal.Token.Kind {
+		case parse.VarTokenKind, parse.DefineTokenKind, parse.ImportTokenKind:
+			continue // Declarations are evaluated when the source is loaded.
+		}
+		if err := evalDirChild(sc, root, e); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func evalDir(parent *dir, e *parse.SExpr) error {
+// The attributes supported by each kind of entity.
+var (
+	dirAttrs = map[string]func(*scope, *dir, *parse.SExpr) error{
+		"exists": evalDirExists,
+		"perms":  evalDirPerms,
+	}
+	fileAttrs = map[string]func(*scope, *file, *parse.SExpr) error{
+		"data":     evalFileData,
+		"exists":   evalFileExists,
+		"perms":    evalFilePerms,
+		"template": evalFileTemplate,
+		"contents": evalFileContents,
+	}
+	linkAttrs = map[string]func(*scope, *link, *parse.SExpr) error{
+		"exists":   evalLinkExists,
+		"symbolic": evalLinkSymbolic,
+	}
+)
+
+// Attributes returns the names of the attributes supported by the given kind of
+// entity, in sorted order. The kind is one of parse.DirTokenKind,
+// parse.FileTokenKind, parse.LinkTokenKind or parse.VarTokenKind.
+func Attributes(kind parse.TokenKind) []string {
+	var names []string
+	switch kind {
+	case parse.DirTokenKind:
+		for name := range dirAttrs {
+			names = append(names, name)
+		}
+	case parse.FileTokenKind:
+		for name := range fileAttrs {
+			names = append(names, name)
+		}
+	case parse.LinkTokenKind:
+		for name := range linkAttrs {
+			names = append(names, name)
+		}
+	case parse.VarTokenKind:
+		for name := range varAttrs {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func evalDir(sc *scope, parent *dir, e *parse.SExpr) error {
 	if len(e.Args) < 1 {
-		return interpretError("expected a directory name")
+		return evalErrorf(e.Literal.Token, codeMissingArgument, "expected a directory name")
 	}
 
-	name, err := evalRelPath(parent, e.Args[0])
+	name, err := evalRelPath(sc, parent, e.Args[0])
 	if err != nil {
 		return err
 	}
@@ -127,7 +246,10 @@ func evalDir(parent *dir, e *parse.SExpr) error {
 		perms: defaultDirMode,
 	}
 	for _, arg := range e.Args[1:] {
-		if err := evalDirChild(d, arg.SExpr); err != nil {
+		if arg.SExpr == nil {
+			return evalErrorf(arg.Token, codeInvalidExpression, "unexpected %v in dir", arg.Token.Value)
+		}
+		if err := evalDirChild(sc, d, arg.SExpr); err != nil {
 			return err
 		}
 	}
@@ -136,40 +258,70 @@ func evalDir(parent *dir, e *parse.SExpr) error {
 	return nil
 }
 
-func evalDirAttr(d *dir, e *parse.SExpr) error {
+func evalDirAttr(sc *scope, d *dir, e *parse.SExpr) error {
 	attr, err := evalAttrName(e.Literal)
 	if err != nil {
 		return err
 	}
-	switch attr {
-	case "perms":
-		return d.setPerms(e.Args)
+	if eval, ok := dirAttrs[attr]; ok {
+		return eval(sc, d, e)
 	}
-	return interpretError("invalid dir attribute %q", attr)
+	return evalErrorf(e.Literal.Token, codeInvalidAttribute, "invalid dir attribute %q", attr)
 }
 
-func evalDirChild(parent *dir, e *parse.SExpr) (err error) {
+func evalDirChild(sc *scope, parent *dir, e *parse.SExpr) (err error) {
 	switch e.Literal.Token.Kind {
 	case parse.AttributeTokenKind:
-		err = evalDirAttr(parent, e)
+		err = evalDirAttr(sc, parent, e)
 	case parse.DirTokenKind:
-		err = evalDir(parent, e)
+		err = evalDir(sc, parent, e)
 	case parse.FileTokenKind:
-		err = evalFile(parent, e)
+		err = evalFile(sc, parent, e)
 	case parse.LinkTokenKind:
-		err = evalLink(parent, e)
+		err = evalLink(sc, parent, e)
+	case parse.IncludeTokenKind:
+		err = evalInclude(sc, parent, e)
+	case parse.UseTokenKind:
+		err = evalUse(sc, parent, e)
+	case parse.WhenTokenKind, parse.UnlessTokenKind:
+		err = evalWhen(sc, parent, e)
+	case parse.ForTokenKind:
+		err = evalFor(sc, parent, e)
+	case parse.VarTokenKind:
+		err = evalErrorf(e.Literal.Token, codeInvalidExpression, "variables must be declared at the top level")
+	case parse.DefineTokenKind:
+		err = evalErrorf(e.Literal.Token, codeInvalidExpression, "fragments must be defined at the top level")
+	case parse.ImportTokenKind:
+		err = evalErrorf(e.Literal.Token, codeInvalidExpression, "imports must be at the top level")
 	default:
-		err = interpretError("invalid s-expression: %v", e.Literal.Token)
+		err = evalErrorf(e.Literal.Token, codeInvalidExpression, "invalid s-expression: %v", e.Literal.Token)
 	}
 	return err
 }
 
-func evalFile(parent *dir, e *parse.SExpr) error {
+func evalDirExists(sc *scope, d *dir, e *parse.SExpr) (err error) {
+	d.exists, err = evalExistsPolicy(sc, e)
+	return err
+}
+
+func evalDirPerms(sc *scope, d *dir, e *parse.SExpr) error {
 	if len(e.Args) < 1 {
-		return interpretError("expected a filename")
+		return evalErrorf(e.Literal.Token, codeMissingArgument, "expected a file mode")
 	}
+	mode, err := evalFileMode(sc, e.Args[0])
+	if err != nil {
+		return err
+	}
+	d.setPerms(mode)
+	return nil
+}
 
-	name, err := evalRelPath(parent, e.Args[0])
+func evalFile(sc *scope, parent *dir, e *parse.SExpr) error {
+	if len(e.Args) < 1 {
+		return evalErrorf(e.Literal.Token, codeMissingArgument, "expected a filename")
+	}
+
+	name, err := evalRelPath(sc, parent, e.Args[0])
 	if err != nil {
 		return err
 	}
@@ -179,7 +331,10 @@ func evalFile(parent *dir, e *parse.SExpr) error {
 		perms: defaultFileMode,
 	}
 	for _, arg := range e.Args[1:] {
-		if err := evalFileChild(f, arg.SExpr); err != nil {
+		if arg.SExpr == nil {
+			return evalErrorf(arg.Token, codeInvalidExpression, "unexpected %v in file", arg.Token.Value)
+		}
+		if err := evalFileChild(sc, f, arg.SExpr); err != nil {
 			return err
 		}
 	}
@@ -188,37 +343,38 @@ func evalFile(parent *dir, e *parse.SExpr) error {
 	return nil
 }
 
-func evalFileAttr(f *file, e *parse.SExpr) error {
+func evalFileAttr(sc *scope, f *file, e *parse.SExpr) error {
 	attr, err := evalAttrName(e.Literal)
 	if err != nil {
 		return err
 	}
-	switch attr {
-	case "perms":
-		return evalFilePerms(f, e.Args)
-	case "template":
-		return evalFileTemplate(f, e.Args)
-	case "contents":
-		return evalFileContents(f, e.Args)
+	if eval, ok := fileAttrs[attr]; ok {
+		return eval(sc, f, e)
 	}
-	return interpretError("invalid file attribute %q", attr)
+	return evalErrorf(e.Literal.Token, codeInvalidAttribute, "invalid file attribute %q", attr)
 }
 
-func evalFileChild(parent *file, e *parse.SExpr) (err error) {
+func evalFileChild(sc *scope, parent *file, e *parse.SExpr) (err error) {
 	switch e.Literal.Token.Kind {
 	case parse.AttributeTokenKind:
-		err = evalFileAttr(parent, e)
+		err = evalFileAttr(sc, parent, e)
 	default:
-		err = interpretError("invalid s-expression: %v", e.Literal.Token)
+		err = evalErrorf(e.Literal.Token, codeInvalidExpression, "invalid s-expression: %v", e.Literal.Token)
 	}
 	return err
 }
 
-func evalFileContents(f *file, args []*parse.Arg) error {
+func evalFileContents(sc *scope, f *file, e *parse.SExpr) error {
 	if f.templatePath != "" {
-		return errors.New("cannot set @contents if @template is set")
+		return evalErrorf(e.Literal.Token, codeInvalidAttribute, "cannot set @contents if @template is set")
 	}
-	contents, err := evalString(args[0])
+	if f.data != nil {
+		return evalErrorf(e.Literal.Token, codeInvalidAttribute, "cannot set @contents if @data is set")
+	}
+	if len(e.Args) < 1 {
+		return evalErrorf(e.Literal.Token, codeMissingArgument, "expected the file contents")
+	}
+	contents, err := evalString(sc, e.Args[0])
 	if err != nil {
 		return err
 	}
@@ -226,8 +382,60 @@ func evalFileContents(f *file, args []*parse.Arg) error {
 	return nil
 }
 
-func evalFilePerms(f *file, args []*parse.Arg) error {
-	mode, err := evalFileMode(args[0])
+// evalFileData evaluates the parameters of a template, given as (key value)
+// pairs. A value is a string, a number, a variable or a list.
+func evalFileData(sc *scope, f *file, e *parse.SExpr) error {
+	if len(f.contents) > 0 {
+		return evalErrorf(e.Literal.Token, codeInvalidAttribute, "cannot set @data if @contents is set")
+	}
+	if len(e.Args) < 1 {
+		return evalErrorf(e.Literal.Token, codeMissingArgument, "expected one or more (key value) pairs")
+	}
+	if f.data == nil {
+		f.data = map[string]interface{}{}
+	}
+	for _, arg := range e.Args {
+		pair := arg.SExpr
+		if pair == nil || len(pair.Args) != 1 {
+			return evalErrorf(arg.Token, codeInvalidArgument, "expected a (key value) pair")
+		}
+		// Keys are identifiers, which may be keywords such as dir.
+		key := pair.Literal.Token.Value
+		if kind := pair.Literal.Token.Kind; kind != parse.IdentTokenKind && !parse.IsKeyword(kind) {
+			return evalErrorf(pair.Literal.Token, codeInvalidArgument, "%v is not a key", pair.Literal.Token)
+		}
+		if _, ok := f.data[key]; ok {
+			return evalErrorf(pair.Literal.Token, codeInvalidArgument, "key %q is already set", key)
+		}
+
+		var value interface{}
+		var err error
+		switch a := pair.Args[0]; {
+		case a.SExpr != nil:
+			value, err = evalList(sc, a)
+		case a.Literal.Token.Kind == parse.NumberTokenKind:
+			value, err = evalNumber(sc, a)
+		default:
+			value, err = evalString(sc, a)
+		}
+		if err != nil {
+			return err
+		}
+		f.data[key] = value
+	}
+	return nil
+}
+
+func evalFileExists(sc *scope, f *file, e *parse.SExpr) (err error) {
+	f.exists, err = evalExistsPolicy(sc, e)
+	return err
+}
+
+func evalFilePerms(sc *scope, f *file, e *parse.SExpr) error {
+	if len(e.Args) < 1 {
+		return evalErrorf(e.Literal.Token, codeMissingArgument, "expected a file mode")
+	}
+	mode, err := evalFileMode(sc, e.Args[0])
 	if err != nil {
 		return err
 	}
@@ -235,24 +443,29 @@ func evalFilePerms(f *file, args []*parse.Arg) error {
 	return nil
 }
 
-func evalFileTemplate(f *file, args []*parse.Arg) error {
+func evalFileTemplate(sc *scope, f *file, e *parse.SExpr) error {
 	if len(f.contents) > 0 {
-		return errors.New("cannot set @template if @contents is set")
+		return evalErrorf(e.Literal.Token, codeInvalidAttribute, "cannot set @template if @contents is set")
+	}
+	if len(e.Args) < 1 {
+		return evalErrorf(e.Literal.Token, codeMissingArgument, "expected a template filename")
 	}
-	filename, err := evalString(args[0])
+	filename, err := evalString(sc, e.Args[0])
 	if err != nil {
 		return err
 	}
-	f.setTemplate(filename)
+	f.setTemplate(sc.thr.findTemplate(sc.unit.path(filename), filename))
+	f.templateAt = parse.NewDiagnostic(sc.unit.filename, sc.unit.source, e.Literal.Token.Pos, e.Literal.Token.End, errInterpret, codeTemplate, "")
+	f.vars, f.lists = sc.vars, sc.lists
 	return nil
 }
 
-func evalLink(parent *dir, e *parse.SExpr) error {
+func evalLink(sc *scope, parent *dir, e *parse.SExpr) error {
 	if len(e.Args) < 2 {
-		return interpretError("expected a link target and name")
+		return evalErrorf(e.Literal.Token, codeMissingArgument, "expected a link target and name")
 	}
 
-	target, err := evalString(e.Args[0])
+	target, err := evalString(sc, e.Args[0])
 	if err != nil {
 		return err
 	}
@@ -260,7 +473,7 @@ func evalLink(parent *dir, e *parse.SExpr) error {
 		target = filepath.Join(parent.name, target)
 	}
 
-	name, err := evalRelPath(parent, e.Args[1])
+	name, err := evalRelPath(sc, parent, e.Args[1])
 	if err != nil {
 		return err
 	}
@@ -270,7 +483,10 @@ func evalLink(parent *dir, e *parse.SExpr) error {
 		target: target,
 	}
 	for _, arg := range e.Args[2:] {
-		if err := evalLinkChild(l, arg.SExpr); err != nil {
+		if arg.SExpr == nil {
+			return evalErrorf(arg.Token, codeInvalidExpression, "unexpected %v in link", arg.Token.Value)
+		}
+		if err := evalLinkChild(sc, l, arg.SExpr); err != nil {
 			return err
 		}
 	}
@@ -279,8 +495,8 @@ func evalLink(parent *dir, e *parse.SExpr) error {
 	return nil
 }
 
-func evalRelPath(parent *dir, a *parse.Arg) (string, error) {
-	name, err := evalString(a)
+func evalRelPath(sc *scope, parent *dir, a *parse.Arg) (string, error) {
+	name, err := evalString(sc, a)
 	if err != nil {
 		return "", err
 	}
@@ -289,142 +505,199 @@ func evalRelPath(parent *dir, a *parse.Arg) (string, error) {
 	return name, nil
 }
 
-func evalLinkAttr(l *link, e *parse.SExpr) error {
+func evalLinkAttr(sc *scope, l *link, e *parse.SExpr) error {
 	attr, err := evalAttrName(e.Literal)
 	if err != nil {
 		return err
 	}
-	switch attr {
-	case "symbolic":
-		l.symbolic = true
-		return nil
+	if eval, ok := linkAttrs[attr]; ok {
+		return eval(sc, l, e)
 	}
-	return interpretError("invalid link attribute %q", attr)
+	return evalErrorf(e.Literal.Token, codeInvalidAttribute, "invalid link attribute %q", attr)
 }
 
-func evalLinkChild(parent *link, e *parse.SExpr) (err error) {
+func evalLinkChild(sc *scope, parent *link, e *parse.SExpr) (err error) {
 	switch e.Literal.Token.Kind {
 	case parse.AttributeTokenKind:
-		err = evalLinkAttr(parent, e)
+		err = evalLinkAttr(sc, parent, e)
 	default:
-		err = interpretError("invalid s-expression: %v", e.Literal.Token.Kind)
+		err = evalErrorf(e.Literal.Token, codeInvalidExpression, "invalid s-expression: %v", e.Literal.Token.Kind)
 	}
 	return err
 }
 
+func evalLinkExists(sc *scope, l *link, e *parse.SExpr) (err error) {
+	l.exists, err = evalExistsPolicy(sc, e)
+	return err
+}
+
+func evalLinkSymbolic(_ *scope, l *link, _ *parse.SExpr) error {
+	l.symbolic = true
+	return nil
+}
+
+func evalExistsPolicy(sc *scope, e *parse.SExpr) (ExistsPolicy, error) {
+	if len(e.Args) < 1 {
+		return "", evalErrorf(e.Literal.Token, codeMissingArgument, "expected a policy name")
+	}
+	name, err := evalString(sc, e.Args[0])
+	if err != nil {
+		return "", err
+	}
+	policy, err := ParseExistsPolicy(name)
+	if err != nil {
+		return "", evalErrorf(e.Args[0].Token, codeInvalidArgument, "%v", err)
+	}
+	return policy, nil
+}
+
 func evalAttrName(l *parse.Literal) (string, error) {
 	if l.Token.Kind != parse.AttributeTokenKind {
-		return "", interpretError("%q is not an attribute", l.Token.Value)
+		return "", evalErrorf(l.Token, codeInvalidAttribute, "%q is not an attribute", l.Token.Value)
 	}
 	// Skip leading '@'.
 	return l.Token.Value[1:], nil
 }
 
-func evalString(a *parse.Arg) (string, error) {
+// evalString evaluates a string, replacing the variable references with their
+// values, or a variable given by a reference or identifier.
+func evalString(sc *scope, a *parse.Arg) (string, error) {
 	l := a.Literal
-	if l == nil || l.Token.Kind != parse.StringTokenKind {
-		return "", interpretError("%v is not a string", a.Token)
-	}
-	return l.Token.Value, nil
+	switch {
+	case l == nil:
+	case l.Token.Kind == parse.StringTokenKind, l.Token.Kind == parse.VariableTokenKind:
+		return sc.interpolate(l.Token)
+	case l.Token.Kind == parse.IdentTokenKind:
+		return sc.lookup(l.Token, l.Token.Value)
+	}
+	return "", evalErrorf(a.Token, codeInvalidArgument, "%v is not a string", a.Token)
 }
 
-func evalFileMode(a *parse.Arg) (os.FileMode, error) {
+// evalNumber evaluates a number, or a variable given by a reference or
+// identifier whose value is read as a number.
+func evalNumber(sc *scope, a *parse.Arg) (string, error) {
 	l := a.Literal
+	switch {
+	case l == nil:
+	case l.Token.Kind == parse.NumberTokenKind:
+		return l.Token.Value, nil
+	case l.Token.Kind == parse.VariableTokenKind:
+		return sc.interpolate(l.Token)
+	case l.Token.Kind == parse.IdentTokenKind:
+		return sc.lookup(l.Token, l.Token.Value)
+	}
+	return "", evalErrorf(a.Token, codeInvalidArgument, "%v is not a number", a.Token)
+}
 
-	if l.Token.Kind != parse.NumberTokenKind || len(l.Token.Value) != 4 {
-		return 0, interpretError("invalid file mode %q", l.Token.Value)
+func evalFileMode(sc *scope, a *parse.Arg) (os.FileMode, error) {
+	value, err := evalNumber(sc, a)
+	if err != nil {
+		return 0, err
 	}
-	n, err := strconv.ParseUint(l.Token.Value, 8, 32)
+	if len(value) != 4 {
+		return 0, evalErrorf(a.Token, codeInvalidArgument, "invalid file mode %q", value)
+	}
+	n, err := strconv.ParseUint(value, 8, 32)
 	if err != nil {
-		return 0, interpretError("invalid file mode %q", l.Token.Value)
+		return 0, evalErrorf(a.Token, codeInvalidArgument, "invalid file mode %q", value)
 	}
 
 	return os.FileMode(uint32(n)), nil
 }
 
 //
-// Generators
+// File contents
 //
 
-func createTree(thr *thread, t *Tree) error {
-	return createDir(thr, t.root)
-}
-
-func createDir(thr *thread, d *dir) error {
-	umask := unix.Umask(0)
-	defer unix.Umask(umask)
+// TemplateData is the data that templates are executed with, as in
+// {{ .Vars.project_name }} or {{ .File.Name }}.
+type TemplateData struct {
+	// Vars are the variables in the scope of the file, as returned by the Var
+	// function. The values of list variables are []string and the others are
+	// strings. Referring to a variable that is not set is an error.
+	Vars map[string]interface{}
 
-	if err := os.MkdirAll(d.name, d.perms); err != nil {
-		return err
-	}
-	for _, child := range d.dirs {
-		if err := createDir(thr, child); err != nil {
-			return err
-		}
-	}
-	for _, child := range d.files {
-		if err := createFile(thr, child); err != nil {
-			return err
-		}
-	}
-	for _, child := range d.links {
-		if err := createLink(thr, child); err != nil {
-			return err
-		}
-	}
+	File TemplateEntry // The file being generated.
+	Dir  TemplateEntry // The file's parent directory.
 
-	return nil
+	// Data are the parameters given to the template with @data. The values of
+	// lists are []string and the others are strings.
+	Data map[string]interface{}
 }
 
-func createFile(thr *thread, f *file) error {
-	umask := unix.Umask(0)
-	defer unix.Umask(umask)
+// TemplateEntry describes a file or directory to a template.
+type TemplateEntry struct {
+	Name  string      // The base name.
+	Path  string      // The path it is generated at, including the root directory.
+	Perms os.FileMode // Use {{ printf "%04o" .File.Perms }} for the octal mode.
+}
 
-	contents, err := fileContents(thr, f)
-	if err != nil {
-		return err
+func newTemplateData(parent *dir, f *file) *TemplateData {
+	vars := map[string]interface{}{}
+	for name, list := range f.lists {
+		vars[name] = list
 	}
-	if err := os.MkdirAll(filepath.Dir(f.name), defaultDirMode); err != nil {
-		return err
+	for name, value := range f.vars {
+		vars[name] = value
 	}
-	return ioutil.WriteFile(f.name, []byte(contents), f.perms)
-}
-
-func createLink(thr *thread, l *link) error {
-	umask := unix.Umask(0)
-	defer unix.Umask(umask)
-
-	if err := os.MkdirAll(filepath.Dir(l.name), defaultDirMode); err != nil {
-		return err
+	data := f.data
+	if data == nil {
+		data = map[string]interface{}{}
 	}
-
-	linker := os.Link
-	if l.symbolic {
-		linker = os.Symlink
+	return &TemplateData{
+		Vars: vars,
+		Data: data,
+		File: TemplateEntry{Name: filepath.Base(f.name), Path: f.name, Perms: f.perms},
+		Dir:  TemplateEntry{Name: filepath.Base(parent.name), Path: parent.name, Perms: parent.perms},
 	}
-
-	return linker(l.target, l.name)
 }
 
-func fileContents(thr *thread, f *file) (string, error) {
+func fileContents(thr *thread, parent *dir, f *file) (string, error) {
 	if len(f.contents) > 0 {
 		return string(f.contents), nil
 	}
 	if len(f.templatePath) > 0 {
-		filename := filepath.Join(thr.sourceRoot, f.templatePath)
-		return execTemplateFile(filename, thr.templateFuncs)
+		filename := f.templatePath
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(thr.sourceRoot, filename)
+		}
+		contents, err := templateContents(thr, parent, f, filename)
+		if err != nil {
+			// The errors from the template package only name the template, so
+			// report where it is used and the file being generated.
+			d := f.templateAt
+			d.Message = fmt.Sprintf("cannot generate %s from template %s: %v", f.name, filename, err)
+			return "", parse.Diagnostics{d}
+		}
+		return contents, nil
 	}
 	return "", nil
 }
 
-func execTemplateFile(filename string, funcMap template.FuncMap) (string, error) {
+func templateContents(thr *thread, parent *dir, f *file, filename string) (string, error) {
+	partials, err := thr.partialFiles()
+	if err != nil {
+		return "", err
+	}
+	return execTemplateFile(filename, partials, thr.funcs(f.vars), newTemplateData(parent, f))
+}
+
+// execTemplateFile executes a template file. The partials are parsed first, so
+// the file can use the templates they define and overrides any of the same name.
+func execTemplateFile(filename string, partials []string, funcMap template.FuncMap, data *TemplateData) (string, error) {
 	name := filepath.Base(filename)
-	tmpl, err := template.New(name).Funcs(funcMap).ParseFiles(filename)
+	tmpl := template.New(name).Funcs(funcMap).Option("missingkey=error")
+	if len(partials) > 0 {
+		if _, err := tmpl.ParseFiles(partials...); err != nil {
+			return "", err
+		}
+	}
+	tmpl, err := tmpl.ParseFiles(filename)
 	if err != nil {
 		return "", err
 	}
 	var contents bytes.Buffer
-	if err := tmpl.Execute(&contents, nil); err != nil {
+	if err := tmpl.Execute(&contents, data); err != nil {
 		return "", err
 	}
 	return contents.String(), nil
@@ -432,6 +705,46 @@ func execTemplateFile(filename string, funcMap template.FuncMap) (string, error)
 
 // Errors.
 
+// Diagnostic codes for interpreter errors.
+const (
+	codeInvalidArgument   = "invalid-argument"
+	codeInvalidAttribute  = "invalid-attribute"
+	codeInvalidExpression = "invalid-expression"
+	codeMissingArgument   = "missing-argument"
+	codeTemplate          = "template-error"
+	codeUndefinedVar      = "undefined-var"
+)
+
 func interpretError(format string, args ...interface{}) error {
 	return parse.Errorf(errInterpret, format, args...)
 }
+
+// evalError is an interpreter error at a token in the source.
+type evalError struct {
+	tok  *parse.Token
+	kind error // errInterpret unless set.
+	code string
+	msg  string
+}
+
+func evalErrorf(t *parse.Token, code, format string, args ...interface{}) error {
+	return &evalError{tok: t, kind: errInterpret, code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *evalError) Error() string {
+	return fmt.Sprintf("%v: %s", e.kind, e.msg)
+}
+
+func (e *evalError) Unwrap() error {
+	return e.kind
+}
+
+// diagnose converts an evalError into parse.Diagnostics pointing into src.
+func diagnose(filename string, src []byte, err error) error {
+	var e *evalError
+	if !errors.As(err, &e) {
+		return err
+	}
+	d := parse.NewDiagnostic(filename, src, e.tok.Pos, e.tok.End, e.kind, e.code, e.msg)
+	return parse.Diagnostics{d}
+}
@@ -5,13 +5,21 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"runtime"
 	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/kendalharland/mktree/parse"
 )
 
+// treeCmpOpts compare trees, ignoring the source positions kept for errors.
+var treeCmpOpts = []cmp.Option{
+	cmp.AllowUnexported(dir{}, file{}, link{}),
+	cmpopts.IgnoreFields(file{}, "templateAt"),
+}
+
 func TestInterpreter_Interpret(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -56,14 +64,14 @@ func TestInterpreter_Interpret(t *testing.T) {
 			name:   "dir_with_perms",
 			source: `(dir "a" (@perms 0555))`,
 			want: []interface{}{
-				&dir{name: "[test_root]/a", perms: os.FileMode(0555) | os.ModeDir},
+				&dir{name: "[test_root]/a", perms: os.FileMode(0555) | os.ModeDir, hasPerms: true},
 			},
 		},
 		{
 			name:   "dir_with_file",
 			source: `(dir "a" (@perms 0555))`,
 			want: []interface{}{
-				&dir{name: "[test_root]/a", perms: os.FileMode(0555) | os.ModeDir},
+				&dir{name: "[test_root]/a", perms: os.FileMode(0555) | os.ModeDir, hasPerms: true},
 			},
 		},
 		// File
@@ -78,7 +86,7 @@ func TestInterpreter_Interpret(t *testing.T) {
 			name:   "file_with_perms",
 			source: `(file "a" (@perms 0712))`,
 			want: []interface{}{
-				&file{name: "[test_root]/a", perms: os.FileMode(0712)},
+				&file{name: "[test_root]/a", perms: os.FileMode(0712), hasPerms: true},
 			},
 		},
 		{
@@ -88,11 +96,46 @@ func TestInterpreter_Interpret(t *testing.T) {
 				&file{name: "[test_root]/a", contents: []byte("this is a test"), perms: defaultFileMode},
 			},
 		},
+		{
+			name:   "file_with_escaped_contents",
+			source: `(file "a" (@contents "say \"hi\"\n\tand \\ bye \u{1F600}"))`,
+			want: []interface{}{
+				&file{name: "[test_root]/a", contents: []byte("say \"hi\"\n\tand \\ bye \U0001F600"), perms: defaultFileMode},
+			},
+		},
+		{
+			name: "file_with_raw_contents",
+			source: `
+			(file "a" (@contents """
+			    first "line"
+			      second \n line
+			    """))
+			(file "b" (@contents """raw "quoted" \t"""))
+			`,
+			want: []interface{}{
+				&file{name: "[test_root]/a", contents: []byte("first \"line\"\n  second \\n line\n"), perms: defaultFileMode},
+				&file{name: "[test_root]/b", contents: []byte("raw \"quoted\" \\t"), perms: defaultFileMode},
+			},
+		},
 		{
 			name:   "file_with_template",
 			source: `(file "a" (@template "template.tmpl"))`,
 			want: []interface{}{
-				&file{name: "[test_root]/a", templatePath: "template.tmpl", perms: defaultFileMode},
+				&file{name: "[test_root]/a", templatePath: "template.tmpl", perms: defaultFileMode, vars: map[string]string{"root_dir": "[test_root]"}, lists: map[string][]string{}},
+			},
+		},
+		{
+			name:   "file_with_template_data",
+			source: `(file "a" (@template "t.tmpl") (@data (name "a") (mode 0644) (dir (list "b" "c"))))`,
+			want: []interface{}{
+				&file{
+					name:         "[test_root]/a",
+					templatePath: "t.tmpl",
+					perms:        defaultFileMode,
+					vars:         map[string]string{"root_dir": "[test_root]"},
+					lists:        map[string][]string{},
+					data:         map[string]interface{}{"name": "a", "mode": "0644", "dir": []string{"b", "c"}},
+				},
 			},
 		},
 		{
@@ -143,6 +186,147 @@ func TestInterpreter_Interpret(t *testing.T) {
 				&file{name: "[test_root]/b", contents: []byte("value"), perms: defaultFileMode},
 			},
 		},
+		{
+			name: "var_default",
+			source: `
+			(var "a" (@default "one") (@doc "The first file."))
+			(var "b" (@default "two"))
+			(file "%(a)")
+			(file "%(b)")
+			`,
+			vars: map[string]string{"b": "three"},
+			want: []interface{}{
+				&file{name: "[test_root]/one", perms: defaultFileMode},
+				&file{name: "[test_root]/three", perms: defaultFileMode},
+			},
+		},
+		{
+			name:   "var_value_is_not_parsed",
+			vars:   map[string]string{"a": `b") (file "c`},
+			source: `(file "%(a)")`,
+			want: []interface{}{
+				&file{name: `[test_root]/b") (file "c`, perms: defaultFileMode},
+			},
+		},
+		{
+			name:   "var_reference_escaped",
+			vars:   map[string]string{"a": "b"},
+			source: `(file "a" (@contents "%%(a) is %(a)"))`,
+			want: []interface{}{
+				&file{name: "[test_root]/a", contents: []byte("%(a) is b"), perms: defaultFileMode},
+			},
+		},
+		{
+			name:   "var_outside_string",
+			vars:   map[string]string{"name": "a", "perms": "0700"},
+			source: `(file %(name) (@perms %(perms)))`,
+			want: []interface{}{
+				&file{name: "[test_root]/a", perms: 0700, hasPerms: true},
+			},
+		},
+		{
+			name: "fragment_with_params",
+			vars: map[string]string{"module": "example.com/m"},
+			source: `
+			(define go-package (name doc)
+				(dir name
+					(file "doc.go" (@contents "// %(doc)\npackage %(name) // %(module)"))))
+			(use go-package "a" "Package a.")
+			(dir "internal" (use go-package "b" module))
+			`,
+			want: []interface{}{
+				&dir{name: "[test_root]/a", perms: defaultDirMode, files: []*file{
+					{name: "[test_root]/a/doc.go", perms: defaultFileMode, contents: []byte("// Package a.\npackage a // example.com/m")},
+				}},
+				&dir{name: "[test_root]/internal", perms: defaultDirMode, dirs: []*dir{
+					{name: "[test_root]/internal/b", perms: defaultDirMode, files: []*file{
+						{name: "[test_root]/internal/b/doc.go", perms: defaultFileMode, contents: []byte("// example.com/m\npackage b // example.com/m")},
+					}},
+				}},
+			},
+		},
+		{
+			name: "fragment_params_are_not_visible_to_used_fragments",
+			source: `
+			(define inner (file name))
+			(define outer (name) (use inner))
+			(use outer "a")
+			`,
+			vars: map[string]string{"name": "global"},
+			want: []interface{}{
+				&file{name: "[test_root]/global", perms: defaultFileMode},
+			},
+		},
+		// Conditions
+		{
+			name: "when",
+			vars: map[string]string{"license": "MIT", "ci": "false", "docs": "yes"},
+			source: `
+			(when (eq license "MIT" "BSD") (file "LICENSE"))
+			(when ci (file "ci.yml"))
+			(unless ci (file "no-ci"))
+			(dir "a" (when docs (@perms 0700) (dir "docs")))
+			`,
+			want: []interface{}{
+				&file{name: "[test_root]/LICENSE", perms: defaultFileMode},
+				&file{name: "[test_root]/no-ci", perms: defaultFileMode},
+				&dir{name: "[test_root]/a", perms: os.FileMode(0700) | os.ModeDir, hasPerms: true, dirs: []*dir{
+					{name: "[test_root]/a/docs", perms: defaultDirMode},
+				}},
+			},
+		},
+		{
+			name: "when_operators",
+			vars: map[string]string{"goos": runtime.GOOS, "a": "1", "empty": ""},
+			source: `
+			(when (and (eq (os) goos) (ne (arch) "")) (file "os"))
+			(when (or empty (not (eq a 1))) (file "or"))
+			(when (and a (Var "a")) (file "and"))
+			(unless (FileExists "[test_root]/missing") (file "missing"))
+			`,
+			want: []interface{}{
+				&file{name: "[test_root]/os", perms: defaultFileMode},
+				&file{name: "[test_root]/and", perms: defaultFileMode},
+				&file{name: "[test_root]/missing", perms: defaultFileMode},
+			},
+		},
+		{
+			name:   "when_false_is_not_evaluated",
+			vars:   map[string]string{"a": "0"},
+			source: `(when a (file undefined))`,
+		},
+		// Loops
+		{
+			name:   "for_list_literal",
+			source: `(for svc in (list "api" "web") (dir svc (file "%(svc).go")))`,
+			want: []interface{}{
+				&dir{name: "[test_root]/api", perms: defaultDirMode, files: []*file{
+					{name: "[test_root]/api/api.go", perms: defaultFileMode},
+				}},
+				&dir{name: "[test_root]/web", perms: defaultDirMode, files: []*file{
+					{name: "[test_root]/web/web.go", perms: defaultFileMode},
+				}},
+			},
+		},
+		{
+			name:   "for_comma_separated_string",
+			vars:   map[string]string{"locales": "en, fr", "empty": ""},
+			source: `(for l in locales (file "%(l).json")) (for x in empty (file x))`,
+			want: []interface{}{
+				&file{name: "[test_root]/en.json", perms: defaultFileMode},
+				&file{name: "[test_root]/fr.json", perms: defaultFileMode},
+			},
+		},
+		{
+			name:   "for_variable_is_only_bound_in_body",
+			vars:   map[string]string{"name": "global"},
+			source: `(for name in (list "a" name) (file name)) (file name)`,
+			want: []interface{}{
+				&file{name: "[test_root]/a", perms: defaultFileMode},
+				&file{name: "[test_root]/global", perms: defaultFileMode},
+				&file{name: "[test_root]/global", perms: defaultFileMode},
+			},
+		},
 		// Link
 		{
 			name: "link",
@@ -166,7 +350,180 @@ func TestInterpreter_Interpret(t *testing.T) {
 				&link{name: "[test_root]/the_link", target: "[test_root]/target", symbolic: true},
 			},
 		},
+		// Exists
+		{
+			name: "exists",
+			source: `
+			(dir "a" (@exists "skip"))
+			(file "b" (@exists "backup"))
+			(link "b" "c" (@exists "overwrite"))
+			`,
+			want: []interface{}{
+				&dir{name: "[test_root]/a", perms: defaultDirMode, exists: ExistsSkip},
+				&file{name: "[test_root]/b", perms: defaultFileMode, exists: ExistsBackup},
+				&link{name: "[test_root]/c", target: "[test_root]/b", exists: ExistsOverwrite},
+			},
+		},
 		// Error cases.
+		{
+			name:    "var_without_default_is_undefined",
+			source:  `(var "a") (file "%(a)")`,
+			wantErr: errUndefinedVar,
+		},
+		{
+			name:    "var_empty_reference",
+			source:  `(file "%()")`,
+			wantErr: parse.ErrSyntax,
+		},
+		{
+			name:    "var_unterminated_reference",
+			source:  `(file "%(a")`,
+			wantErr: parse.ErrSyntax,
+		},
+		{
+			name:    "var_value_is_not_a_file_mode",
+			vars:    map[string]string{"perms": "(@perms 0700)"},
+			source:  `(file "a" (@perms %(perms)))`,
+			wantErr: errInterpret,
+		},
+		{
+			name:    "fragment_wrong_number_of_args",
+			source:  `(define a (name) (file name)) (use a)`,
+			wantErr: errInterpret,
+		},
+		{
+			name:    "fragment_param_declared_twice",
+			source:  `(define a (name name) (file name))`,
+			wantErr: errInterpret,
+		},
+		{
+			name:    "fragment_param_not_an_identifier",
+			source:  `(define a (name "doc") (file name))`,
+			wantErr: errInterpret,
+		},
+		{
+			name:    "identifier_undefined",
+			source:  `(file name)`,
+			wantErr: errUndefinedVar,
+		},
+		{
+			name:    "file_data_with_contents",
+			source:  `(file "a" (@contents "a") (@data (name "a")))`,
+			wantErr: errInterpret,
+		},
+		{
+			name:    "file_data_key_set_twice",
+			source:  `(file "a" (@template "t.tmpl") (@data (name "a")) (@data (name "b")))`,
+			wantErr: errInterpret,
+		},
+		{
+			name:    "file_data_not_a_pair",
+			source:  `(file "a" (@template "t.tmpl") (@data (name "a" "b")))`,
+			wantErr: errInterpret,
+		},
+		{
+			name:    "file_data_key_not_an_identifier",
+			source:  `(file "a" (@template "t.tmpl") (@data ("name" "a")))`,
+			wantErr: errInterpret,
+		},
+		{
+			name:    "when_without_condition",
+			source:  `(when)`,
+			wantErr: errInterpret,
+		},
+		{
+			name:    "when_undefined_function",
+			source:  `(when (exists "a") (file "a"))`,
+			wantErr: errInterpret,
+		},
+		{
+			name:    "when_function_wrong_argument_type",
+			source:  `(when (FileExists (eq 1 1)) (file "a"))`,
+			wantErr: errInterpret,
+		},
+		{
+			name:    "when_function_error",
+			source:  `(when (Var "undefined") (file "a"))`,
+			wantErr: errInterpret,
+		},
+		{
+			name:    "when_condition_undefined_var",
+			source:  `(unless (eq name "a") (file "a"))`,
+			wantErr: errUndefinedVar,
+		},
+		{
+			name:    "for_without_in",
+			source:  `(for x of (list "a") (file x))`,
+			wantErr: errInterpret,
+		},
+		{
+			name:    "for_not_a_list",
+			source:  `(for x in (eq "a" "b") (file x))`,
+			wantErr: errInterpret,
+		},
+		{
+			name:    "for_variable_not_an_identifier",
+			source:  `(for "x" in (list "a") (file x))`,
+			wantErr: errInterpret,
+		},
+		{
+			name:    "var_not_at_top_level",
+			source:  `(dir "a" (var "b" (@default "c")))`,
+			wantErr: errInterpret,
+		},
+		{
+			name:    "var_declared_twice",
+			source:  `(var "a") (var "a")`,
+			wantErr: errInterpret,
+		},
+		{
+			name:    "var_invalid_name",
+			source:  `(var "a b")`,
+			wantErr: errInterpret,
+		},
+		{
+			name:    "var_invalid_type",
+			source:  `(var "a" (@type "float"))`,
+			wantErr: errInterpret,
+		},
+		{
+			name:    "var_invalid_pattern",
+			source:  `(var "a" (@pattern "("))`,
+			wantErr: errInterpret,
+		},
+		{
+			name:    "var_invalid_default",
+			source:  `(var "a" (@type "int") (@default "one"))`,
+			wantErr: errInterpret,
+		},
+		{
+			name:    "var_value_not_a_choice",
+			vars:    map[string]string{"a": "gpl"},
+			source:  `(var "a" (@choices "mit" "apache")) (file "%(a)")`,
+			wantErr: errInvalidVar,
+		},
+		{
+			name:    "var_value_does_not_match_pattern",
+			vars:    map[string]string{"a": "Hello"},
+			source:  `(var "a" (@pattern "[a-z]+")) (file "%(a)")`,
+			wantErr: errInvalidVar,
+		},
+		{
+			name:    "var_value_too_long",
+			vars:    map[string]string{"a": "abcd"},
+			source:  `(var "a" (@minlen 2) (@maxlen 3)) (file "%(a)")`,
+			wantErr: errInvalidVar,
+		},
+		{
+			name:    "exists_invalid_policy",
+			source:  `(file "a" (@exists "replace"))`,
+			wantErr: errInterpret,
+		},
+		{
+			name:    "exists_missing_policy",
+			source:  `(dir "a" (@exists))`,
+			wantErr: errInterpret,
+		},
 		{
 			name:    "file_missing_name",
 			source:  `(file)`,
@@ -213,6 +570,26 @@ func TestInterpreter_Interpret(t *testing.T) {
 			source:  `(file "a" (@template "a.tmpl") (@content "this is a"))`,
 			wantErr: errInterpret,
 		},
+		{
+			name:    "unterminated_string",
+			source:  `(file "a" (@contents "oops))`,
+			wantErr: parse.ErrSyntax,
+		},
+		{
+			name:    "unterminated_raw_string",
+			source:  `(file "a" (@contents """oops"))`,
+			wantErr: parse.ErrSyntax,
+		},
+		{
+			name:    "invalid_escape_sequence",
+			source:  `(file "a" (@contents "\q"))`,
+			wantErr: parse.ErrSyntax,
+		},
+		{
+			name:    "invalid_unicode_escape_sequence",
+			source:  `(file "a" (@contents "\u{110000}"))`,
+			wantErr: parse.ErrSyntax,
+		},
 		{
 			name:    "dir_perms_invalid_neg_file_mode",
 			source:  `(dir "a" (@perms -1))`, // Grammar excludes negative ints.
@@ -257,7 +634,7 @@ func TestInterpreter_Interpret(t *testing.T) {
 				t.Fatalf("Interpret(`%s`) wanted error but got %+v", test.source, tree.root)
 			}
 
-			if diff := cmp.Diff(want, tree.root, cmp.AllowUnexported(dir{}, file{}, link{})); diff != "" {
+			if diff := cmp.Diff(want, tree.root, treeCmpOpts...); diff != "" {
 				t.Fatalf("Interpret(`%s`) got diff (+got,-want):\n%s\n", test.source, diff)
 			}
 		})
@@ -273,3 +650,47 @@ func mkdir(root string, entries []interface{}) (*dir, error) {
 	}
 	return d, nil
 }
+
+func TestInterpreter_ErrorPosition(t *testing.T) {
+	source := "(dir \"a\"\n    (file \"b\" (@perms \"nan\")))"
+	i := &Interpreter{Root: "[test_root]"}
+	_, err := i.InterpretFile(strings.NewReader(source), "layout.tree")
+
+	var diags parse.Diagnostics
+	if !errors.As(err, &diags) || len(diags) != 1 {
+		t.Fatalf("Interpret(`%s`) wanted one diagnostic but got %v", source, err)
+	}
+	d := diags[0]
+	if d.Filename != "layout.tree" || d.Line != 2 || d.Column != 23 || d.Code != codeInvalidArgument {
+		t.Fatalf("Interpret(`%s`) got unexpected diagnostic %+v", source, d)
+	}
+	if !errors.Is(err, errInterpret) {
+		t.Fatalf("Interpret(`%s`) wanted a %v but got %v", source, errInterpret, err)
+	}
+}
+
+func TestInterpreter_ErrorPositionAfterInterpolation(t *testing.T) {
+	source := "(dir \"%(a)\"\n    (file \"%(b)\" (@perms \"nan\")))"
+	i := &Interpreter{Root: "[test_root]", Vars: map[string]string{"a": "one\ntwo\nthree"}}
+	_, err := i.InterpretFile(strings.NewReader(source), "layout.tree")
+
+	var diags parse.Diagnostics
+	if !errors.As(err, &diags) || len(diags) != 1 {
+		t.Fatalf("Interpret(`%s`) wanted one diagnostic but got %v", source, err)
+	}
+	if d := diags[0]; d.Line != 2 || d.Column != 11 || d.Code != codeUndefinedVar {
+		t.Fatalf("Interpret(`%s`) got unexpected diagnostic %+v", source, d)
+	}
+	if !errors.Is(err, errUndefinedVar) {
+		t.Fatalf("Interpret(`%s`) wanted a %v but got %v", source, errUndefinedVar, err)
+	}
+
+	i.Vars["b"] = "b"
+	_, err = i.InterpretFile(strings.NewReader(source), "layout.tree")
+	if !errors.As(err, &diags) || len(diags) != 1 {
+		t.Fatalf("Interpret(`%s`) wanted one diagnostic but got %v", source, err)
+	}
+	if d := diags[0]; d.Line != 2 || d.Column != 26 || d.Code != codeInvalidArgument {
+		t.Fatalf("Interpret(`%s`) got unexpected diagnostic %+v", source, d)
+	}
+}
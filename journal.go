@@ -0,0 +1,157 @@
+package mktree
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// journal makes changes to the filesystem and records how to undo them, so that
+// a plan can be rolled back if one of its changes fails.
+type journal struct {
+	fs      FS
+	undo    []func() error
+	cleanup []string // Paths removed once the plan is applied or rolled back.
+}
+
+func (j *journal) record(undo func() error) {
+	j.undo = append(j.undo, undo)
+}
+
+// created records that name was created.
+func (j *journal) created(name string) {
+	j.record(func() error {
+		if err := j.fs.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+// mkdirAll is like os.MkdirAll.
+func (j *journal) mkdirAll(name string, perm os.FileMode) error {
+	// Find the directories that will be created, deepest first.
+	var missing []string
+	for dir := name; ; dir = filepath.Dir(dir) {
+		if _, err := j.fs.Lstat(dir); !os.IsNotExist(err) {
+			break
+		}
+		missing = append(missing, dir)
+		if filepath.Dir(dir) == dir {
+			break
+		}
+	}
+	if len(missing) == 0 {
+		stat, err := j.fs.Stat(name)
+		if err != nil {
+			return err
+		}
+		if !stat.IsDir() {
+			return pathError("mkdir", name, syscall.ENOTDIR)
+		}
+		return nil
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := j.fs.Mkdir(missing[i], perm); err != nil {
+			return err
+		}
+		j.created(missing[i])
+	}
+	return nil
+}
+
+// writeFile writes data to the named file and sets its mode to perm.
+func (j *journal) writeFile(name string, data []byte, perm os.FileMode) error {
+	stat, err := j.fs.Lstat(name)
+	switch {
+	case os.IsNotExist(err):
+		j.created(name)
+	case err != nil:
+		return err
+	default:
+		old, err := j.fs.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		mode := stat.Mode()
+		j.record(func() error { return j.fs.WriteFile(name, old, mode) })
+	}
+	return j.fs.WriteFile(name, data, perm)
+}
+
+// chmod is like os.Chmod.
+func (j *journal) chmod(name string, mode os.FileMode) error {
+	stat, err := j.fs.Stat(name)
+	if err != nil {
+		return err
+	}
+	if err := j.fs.Chmod(name, mode); err != nil {
+		return err
+	}
+	old := stat.Mode()
+	j.record(func() error { return j.fs.Chmod(name, old) })
+	return nil
+}
+
+// rename is like os.Rename.
+func (j *journal) rename(oldpath, newpath string) error {
+	if err := j.fs.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	j.record(func() error { return j.fs.Rename(newpath, oldpath) })
+	return nil
+}
+
+// remove removes the named file or directory and everything it contains. The
+// entry is moved to a temporary directory and only deleted once the plan is
+// applied, so that it can be restored.
+func (j *journal) remove(name string) error {
+	tmp, err := j.tempDir(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	j.cleanup = append(j.cleanup, tmp)
+	return j.rename(name, filepath.Join(tmp, filepath.Base(name)))
+}
+
+// rollback undoes every recorded change, most recent first.
+func (j *journal) rollback() error {
+	var errs []string
+	for i := len(j.undo) - 1; i >= 0; i-- {
+		if err := j.undo[i](); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	j.undo = nil
+	if err := j.commit(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("rollback failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// commit deletes the entries removed by the journal.
+func (j *journal) commit() error {
+	for _, name := range j.cleanup {
+		if err := j.fs.RemoveAll(name); err != nil {
+			return err
+		}
+	}
+	j.cleanup = nil
+	return nil
+}
+
+// tempDir creates a new, empty directory in dir.
+func (j *journal) tempDir(dir string) (string, error) {
+	for n := 0; ; n++ {
+		name := filepath.Join(dir, fmt.Sprintf(".mktree-%d", n))
+		err := j.fs.Mkdir(name, 0700)
+		if !os.IsExist(err) {
+			return name, err
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package mktree
+
+import (
+	"embed"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The license texts use the placeholders <year> and <copyright holders>, except
+// for the notice in the appendix of Apache-2.0, which uses [yyyy] and [name of
+// copyright owner]. The Unlicense has no copyright notice.
+//
+//go:embed licenses/*.txt
+var licenseFiles embed.FS
+
+// License returns the text of the license with the given SPDX identifier, such
+// as "MIT" or "Apache-2.0", with the current year and the given copyright
+// holder filled in. The holder is not used by licenses without a copyright
+// notice, such as the Unlicense.
+func License(id, holder string) (string, error) {
+	text, err := licenseFiles.ReadFile("licenses/" + id + ".txt")
+	if err != nil {
+		return "", fmt.Errorf("unknown license %q: must be one of %s", id, strings.Join(Licenses(), ", "))
+	}
+	year := strconv.Itoa(time.Now().Year())
+	return strings.NewReplacer(
+		"<year>", year,
+		"<copyright holders>", holder,
+		"[yyyy]", year,
+		"[name of copyright owner]", holder,
+	).Replace(string(text)), nil
+}
+
+// Licenses returns the SPDX identifiers of the licenses known to License.
+func Licenses() []string {
+	entries, _ := licenseFiles.ReadDir("licenses")
+	var ids []string
+	for _, e := range entries {
+		ids = append(ids, strings.TrimSuffix(e.Name(), ".txt"))
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,75 @@
+package mktree
+
+import "github.com/kendalharland/mktree/parse"
+
+// evalFor evaluates the children of a for expression as children of parent once
+// for each element of a list, with the element bound to a variable:
+//
+//	(for name in list children...)
+func evalFor(sc *scope, parent *dir, e *parse.SExpr) error {
+	if len(e.Args) < 3 {
+		return evalErrorf(e.Literal.Token, codeMissingArgument, "expected a variable name, 'in' and a list")
+	}
+	name, err := evalIdent(e.Args[0])
+	if err != nil {
+		return err
+	}
+	if in := e.Args[1].Literal; in == nil || in.Token.Kind != parse.IdentTokenKind || in.Token.Value != "in" {
+		return evalErrorf(e.Args[1].Token, codeInvalidArgument, "expected 'in' but got %v", e.Args[1].Token.Value)
+	}
+	list, err := evalList(sc, e.Args[2])
+	if err != nil {
+		return err
+	}
+	body := e.Args[3:]
+	for _, arg := range body {
+		if arg.SExpr == nil {
+			return evalErrorf(arg.Token, codeInvalidExpression, "unexpected %v in for", arg.Token.Value)
+		}
+	}
+
+	for _, value := range list {
+		vars := map[string]string{}
+		for name, value := range sc.vars {
+			vars[name] = value
+		}
+		vars[name] = value
+		child := *sc
+		child.vars = vars
+		for _, arg := range body {
+			if err := evalDirChild(&child, parent, arg.SExpr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// evalList evaluates a list: a list literal such as (list "a" "b"), a list
+// variable, or a string whose elements are separated by commas.
+func evalList(sc *scope, a *parse.Arg) ([]string, error) {
+	if e := a.SExpr; e != nil {
+		if t := e.Literal.Token; t.Kind != parse.IdentTokenKind || t.Value != "list" {
+			return nil, evalErrorf(t, codeInvalidExpression, "%v is not a list", t)
+		}
+		var list []string
+		for _, arg := range e.Args {
+			value, err := evalString(sc, arg)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		return list, nil
+	}
+	if t := a.Literal.Token; t.Kind == parse.IdentTokenKind {
+		if list, ok := sc.lists[t.Value]; ok {
+			return list, nil
+		}
+	}
+	value, err := evalString(sc, a)
+	if err != nil {
+		return nil, err
+	}
+	return splitList(value), nil
+}
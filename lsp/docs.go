@@ -0,0 +1,92 @@
+package lsp
+
+import "github.com/kendalharland/mktree/parse"
+
+// Hover documentation for keywords, in markdown.
+var keywordDocs = map[parse.TokenKind]string{
+	parse.DefineTokenKind: "```\n(define <name> [(<params>...)] [children...])\n```\n" +
+		"Defines a fragment: a named list of entities that is created wherever it is used " +
+		"with `use`. Parameters are variables set by the arguments of `use`. Must appear at the top level.",
+	parse.DirTokenKind: "```\n(dir <dirname> [attributes... | children...])\n```\n" +
+		"Generates a directory. The name is evaluated relative to its parent directory. " +
+		"Attributes and children may be given in any order.",
+	parse.FileTokenKind: "```\n(file <filename> [attributes...])\n```\n" +
+		"Generates a regular file. The name is evaluated relative to its parent directory.",
+	parse.ForTokenKind: "```\n(for <name> in <list> [children...])\n```\n" +
+		"Creates its children in the enclosing directory once for each element of a list, " +
+		"with the element bound to the variable `name`. The list is a literal such as " +
+		"`(list \"a\" \"b\")`, a list variable, or a string separated by commas.",
+	parse.ImportTokenKind: "```\n(import <filename>)\n```\n" +
+		"Makes the fragments defined in another source file available to `use`, without " +
+		"creating its entities. The filename is relative to this file. Must appear at the top level.",
+	parse.IncludeTokenKind: "```\n(include <filename>)\n```\n" +
+		"Creates the entities of another source file in the enclosing directory. The filename " +
+		"is relative to this file.",
+	parse.LinkTokenKind: "```\n(link <target> <link-name> [attributes...])\n```\n" +
+		"Creates a link to a file or directory. Links are hard links unless `@symbolic` is set.",
+	parse.UnlessTokenKind: "```\n(unless <condition> [children...])\n```\n" +
+		"Creates its children in the enclosing directory if the condition is false.",
+	parse.UseTokenKind: "```\n(use <name> [arguments...])\n```\n" +
+		"Creates the entities of a fragment declared with `define` in the enclosing directory, " +
+		"with one argument for each of its parameters.",
+	parse.VarTokenKind: "```\n(var <name> [attributes...])\n```\n" +
+		"Declares a variable that can be set with `-vars`. Must appear at the top level.",
+	parse.WhenTokenKind: "```\n(when <condition> [children...])\n```\n" +
+		"Creates its children in the enclosing directory if the condition is true. A condition " +
+		"is a value, which is false if empty or a false boolean, or a call such as " +
+		"`(eq license \"MIT\")`, `(not c)`, `(and c...)`, `(or c...)`, `(os)`, `(arch)` or a template function.",
+}
+
+// The keywords offered as completions, in order.
+var keywords = []parse.TokenKind{
+	parse.DefineTokenKind,
+	parse.DirTokenKind,
+	parse.FileTokenKind,
+	parse.ForTokenKind,
+	parse.ImportTokenKind,
+	parse.IncludeTokenKind,
+	parse.LinkTokenKind,
+	parse.UnlessTokenKind,
+	parse.UseTokenKind,
+	parse.VarTokenKind,
+	parse.WhenTokenKind,
+}
+
+// Hover documentation for attributes, in markdown, keyed by name without the '@'.
+var attributeDocs = map[string]string{
+	"choices": "```\n(@choices <value>...)\n```\n" +
+		"The values the variable may have.",
+	"contents": "```\n(@contents <value>)\n```\n" +
+		"Declares a string to use as the file contents. Cannot be combined with `@template`.",
+	"data": "```\n(@data (<key> <value>)...)\n```\n" +
+		"Parameters for the file's template, available to it as `.Data.<key>`. A value is a " +
+		"string, a number, a variable or a list such as `(list \"a\" \"b\")`.",
+	"default": "```\n(@default <value>)\n```\n" +
+		"The value of the variable if it is not set. Variables without a default must be set.",
+	"doc": "```\n(@doc <description>)\n```\n" +
+		"Describes the variable. Shown by `mktree vars`.",
+	"exists": "```\n(@exists <policy>)\n```\n" +
+		"What to do if the entity already exists and differs from the tree: `\"skip\"`, " +
+		"`\"overwrite\"`, `\"error\"` or `\"backup\"`. Applies to the entity and its children.",
+	"maxlen": "```\n(@maxlen <n>)\n```\n" +
+		"The maximum length of the variable's value in characters.",
+	"minlen": "```\n(@minlen <n>)\n```\n" +
+		"The minimum length of the variable's value in characters.",
+	"pattern": "```\n(@pattern <regexp>)\n```\n" +
+		"A Go regular expression that must match the whole value of the variable.",
+	"perms": "```\n(@perms <mode>)\n```\n" +
+		"Declares the Unix permissions of the entity as 4 octal digits such as `0755`.",
+	"symbolic": "```\n(@symbolic)\n```\n" +
+		"Creates a symbolic link instead of a hard one.",
+	"type": "```\n(@type <type>)\n```\n" +
+		"The type of the variable's value: `\"string\"` (the default), `\"int\"`, `\"bool\"` or `\"list\"`.",
+	"template": "```\n(@template <filename>)\n```\n" +
+		"The path to a Go template to execute to generate the file contents, relative to " +
+		"the directory of the source file or a directory in the template search path. " +
+		"Cannot be combined with `@contents`.",
+}
+
+// Hover documentation for builtin variables, in markdown.
+var variableDocs = map[string]string{
+	"root_dir": "The directory where mktree creates all other files and directories.",
+}
@@ -0,0 +1,526 @@
+// Package lsp implements a Language Server Protocol server for mktree source files.
+package lsp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/kendalharland/mktree"
+	"github.com/kendalharland/mktree/parse"
+)
+
+// Server is a language server for mktree source files.
+type Server struct {
+	// Vars are the variables used when checking documents. Variables missing from
+	// this map are allowed and are offered as completions if used in the document.
+	Vars map[string]string
+
+	// TemplatePath are the directories searched for templates, as in
+	// mktree.Interpreter.
+	TemplatePath []string
+
+	conn *conn
+	docs map[string]string // Document text by URI.
+}
+
+// Serve handles requests read from r and writes responses to w until the client
+// sends the exit notification or r is closed.
+func (s *Server) Serve(r io.Reader, w io.Writer) error {
+	s.conn = newConn(r, w)
+	s.docs = map[string]string{}
+	for {
+		body, err := s.conn.read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var req request
+		if err := json.Unmarshal(body, &req); err != nil {
+			if err := s.reply(nil, nil, &responseError{codeParseError, err.Error()}); err != nil {
+				return err
+			}
+			continue
+		}
+		if req.Method == "exit" {
+			return nil
+		}
+
+		result, rerr := s.handle(&req)
+		if req.ID == nil {
+			continue // Notifications have no response.
+		}
+		if err := s.reply(req.ID, result, rerr); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) reply(id *json.RawMessage, result interface{}, rerr *responseError) error {
+	return s.conn.write(&response{JSONRPC: "2.0", ID: id, Result: result, Error: rerr})
+}
+
+func (s *Server) notify(method string, params interface{}) error {
+	return s.conn.write(&notification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+func (s *Server) handle(req *request) (interface{}, *responseError) {
+	switch req.Method {
+	case "initialize":
+		return s.initialize(), nil
+	case "shutdown":
+		return nil, nil
+	case "textDocument/didOpen":
+		var params didOpenTextDocumentParams
+		return decode(req, &params, func() (interface{}, error) {
+			s.docs[params.TextDocument.URI] = params.TextDocument.Text
+			return nil, s.publishDiagnostics(params.TextDocument.URI)
+		})
+	case "textDocument/didChange":
+		var params didChangeTextDocumentParams
+		return decode(req, &params, func() (interface{}, error) {
+			if n := len(params.ContentChanges); n > 0 {
+				s.docs[params.TextDocument.URI] = params.ContentChanges[n-1].Text
+			}
+			return nil, nil
+		})
+	case "textDocument/didSave":
+		var params didSaveTextDocumentParams
+		return decode(req, &params, func() (interface{}, error) {
+			if params.Text != nil {
+				s.docs[params.TextDocument.URI] = *params.Text
+			}
+			return nil, s.publishDiagnostics(params.TextDocument.URI)
+		})
+	case "textDocument/didClose":
+		var params didCloseTextDocumentParams
+		return decode(req, &params, func() (interface{}, error) {
+			delete(s.docs, params.TextDocument.URI)
+			return nil, s.notify("textDocument/publishDiagnostics", &publishDiagnosticsParams{
+				URI:         params.TextDocument.URI,
+				Diagnostics: []Diagnostic{},
+			})
+		})
+	case "textDocument/hover":
+		var params textDocumentPositionParams
+		return decode(req, &params, func() (interface{}, error) {
+			return s.hover(params.TextDocument.URI, params.Position), nil
+		})
+	case "textDocument/completion":
+		var params textDocumentPositionParams
+		return decode(req, &params, func() (interface{}, error) {
+			return s.completion(params.TextDocument.URI, params.Position), nil
+		})
+	case "textDocument/definition":
+		var params textDocumentPositionParams
+		return decode(req, &params, func() (interface{}, error) {
+			return s.definition(params.TextDocument.URI, params.Position), nil
+		})
+	}
+	if req.ID == nil || strings.HasPrefix(req.Method, "$/") {
+		return nil, nil
+	}
+	return nil, &responseError{codeMethodNotFound, fmt.Sprintf("method not found: %s", req.Method)}
+}
+
+// decode unmarshals the request params into v and then calls f.
+func decode(req *request, v interface{}, f func() (interface{}, error)) (interface{}, *responseError) {
+	if err := json.Unmarshal(req.Params, v); err != nil {
+		return nil, &responseError{codeInvalidParams, err.Error()}
+	}
+	result, err := f()
+	if err != nil {
+		return nil, &responseError{codeInvalidParams, err.Error()}
+	}
+	return result, nil
+}
+
+func (s *Server) initialize() *initializeResult {
+	return &initializeResult{
+		Capabilities: serverCapabilities{
+			TextDocumentSync: textDocumentSyncOptions{
+				OpenClose: true,
+				Change:    1,
+				Save:      saveOptions{IncludeText: true},
+			},
+			HoverProvider: true,
+			CompletionProvider: completionOptions{
+				TriggerCharacters: []string{"(", "@", "%"},
+			},
+			DefinitionProvider: true,
+		},
+		ServerInfo: serverInfo{Name: "mktree", Version: strings.TrimSpace(mktree.Version())},
+	}
+}
+
+//
+// Diagnostics
+//
+
+func (s *Server) publishDiagnostics(uri string) error {
+	return s.notify("textDocument/publishDiagnostics", &publishDiagnosticsParams{
+		URI:         uri,
+		Diagnostics: s.diagnostics(uri),
+	})
+}
+
+func (s *Server) diagnostics(uri string) []Diagnostic {
+	text := s.docs[uri]
+	vars := map[string]string{}
+	for k, v := range s.Vars {
+		vars[k] = v
+	}
+	i := &mktree.Interpreter{Vars: vars, AllowUndefinedVars: true, TemplatePath: s.TemplatePath}
+	_, err := i.InterpretFile(strings.NewReader(text), uriToPath(uri))
+	if err == nil {
+		return []Diagnostic{}
+	}
+
+	var diags parse.Diagnostics
+	if !errors.As(err, &diags) {
+		return []Diagnostic{{Severity: severityError, Source: "mktree", Message: err.Error()}}
+	}
+	filename := filepath.Clean(uriToPath(uri))
+	out := make([]Diagnostic, 0, len(diags))
+	for _, d := range diags {
+		severity := severityError
+		if d.Severity == parse.SeverityWarning {
+			severity = severityWarning
+		}
+		r := Range{offsetToPosition(text, d.Start), offsetToPosition(text, d.End)}
+		message := fmt.Sprintf("%v: %s", d.Kind, d.Message)
+		// The offsets of a diagnostic in an included or imported file are not
+		// offsets in this document, so report it at the start of the document.
+		if filepath.Clean(d.Filename) != filename {
+			r = Range{}
+			message = fmt.Sprintf("%s:%d:%d: %s", d.Filename, d.Line, d.Column, message)
+		}
+		out = append(out, Diagnostic{
+			Range:    r,
+			Severity: severity,
+			Code:     d.Code,
+			Source:   "mktree",
+			Message:  message,
+		})
+	}
+	return out
+}
+
+//
+// Hover
+//
+
+func (s *Server) hover(uri string, pos Position) *hover {
+	text := s.docs[uri]
+	offset := positionToOffset(text, pos)
+	t := tokenAt(text, offset)
+	if t == nil {
+		return nil
+	}
+
+	doc := keywordDocs[t.Kind]
+	start, end := t.Pos, t.End
+	switch t.Kind {
+	case parse.AttributeTokenKind:
+		doc = attributeDocs[strings.TrimPrefix(t.Value, "@")]
+	case parse.VariableTokenKind, parse.StringTokenKind:
+		// Look for a reference in the token's source, since escape sequences
+		// make offsets in the value differ from offsets in the text.
+		refs, _ := parse.References(text[t.Pos:t.End])
+		for _, ref := range refs {
+			if t.Pos+ref.Start <= offset && offset < t.Pos+ref.End {
+				doc = variableDoc(text, ref.Name)
+				start, end = t.Pos+ref.Start, t.Pos+ref.End
+			}
+		}
+	}
+	if doc == "" {
+		return nil
+	}
+	r := Range{offsetToPosition(text, start), offsetToPosition(text, end)}
+	return &hover{Contents: markupContent{Kind: "markdown", Value: doc}, Range: &r}
+}
+
+// tokenAt returns the token spanning the given offset, if any.
+func tokenAt(text string, offset int) *parse.Token {
+	for _, t := range parse.Tokens([]byte(text)) {
+		if t.Pos <= offset && offset < t.End {
+			return t
+		}
+	}
+	return nil
+}
+
+//
+// Completion
+//
+
+var (
+	// A partial variable reference ending at the cursor, but not an escaped %%(.
+	partialVariable = regexp.MustCompile(`(?:^|[^%])%\(\s*([A-Za-z0-9_]*)$`)
+	// A partial attribute ending at the cursor.
+	partialAttribute = regexp.MustCompile(`\(\s*(@[A-Za-z0-9_-]*)$`)
+	// A partial keyword ending at the cursor.
+	partialKeyword = regexp.MustCompile(`\(\s*([A-Za-z]*)$`)
+)
+
+func (s *Server) completion(uri string, pos Position) *completionList {
+	text := s.docs[uri]
+	offset := positionToOffset(text, pos)
+	before := text[:offset]
+	line := before[strings.LastIndexByte(before, '\n')+1:]
+
+	list := &completionList{Items: []completionItem{}}
+	edit := func(prefix, newText string) *textEdit {
+		start := offsetToPosition(text, offset-len(prefix))
+		return &textEdit{Range: Range{start, pos}, NewText: newText}
+	}
+
+	if m := partialVariable.FindStringSubmatch(line); m != nil {
+		for _, name := range s.variables(text) {
+			item := completionItem{Label: name, Kind: completionKindVariable, TextEdit: edit(m[1], name)}
+			if doc := variableDoc(text, name); doc != "" {
+				item.Documentation = &markupContent{Kind: "markdown", Value: doc}
+			}
+			list.Items = append(list.Items, item)
+		}
+		return list
+	}
+
+	// Ignore the cursor if it is inside a string or comment.
+	if t := tokenAt(text, offset-1); t != nil && (t.Kind == parse.StringTokenKind || t.Kind == parse.CommentTokenKind) {
+		return list
+	}
+
+	if m := partialAttribute.FindStringSubmatch(line); m != nil {
+		// The attribute's own s-expression is open, so look at its parent.
+		open := len(before) - len(m[0])
+		kind := enclosingEntity(before[:open])
+		for _, name := range mktree.Attributes(kind) {
+			label := "@" + name
+			item := completionItem{
+				Label:    label,
+				Kind:     completionKindProperty,
+				Detail:   fmt.Sprintf("%s attribute", kind),
+				TextEdit: edit(m[1], label),
+			}
+			if doc, ok := attributeDocs[name]; ok {
+				item.Documentation = &markupContent{Kind: "markdown", Value: doc}
+			}
+			list.Items = append(list.Items, item)
+		}
+		return list
+	}
+
+	if m := partialKeyword.FindStringSubmatch(line); m != nil {
+		for _, kind := range keywords {
+			list.Items = append(list.Items, completionItem{
+				Label:         string(kind),
+				Kind:          completionKindKeyword,
+				Documentation: &markupContent{Kind: "markdown", Value: keywordDocs[kind]},
+				TextEdit:      edit(m[1], string(kind)),
+			})
+		}
+	}
+	return list
+}
+
+// variables returns the names of all variables known to the server or used in text.
+func (s *Server) variables(text string) []string {
+	seen := map[string]bool{"root_dir": true}
+	for name := range s.Vars {
+		seen[name] = true
+	}
+	for _, t := range parse.Tokens([]byte(text)) {
+		if t.Kind != parse.StringTokenKind && t.Kind != parse.VariableTokenKind {
+			continue
+		}
+		refs, _ := parse.References(t.Value)
+		for _, ref := range refs {
+			seen[ref.Name] = true
+		}
+	}
+	for _, v := range declaredVars(text) {
+		seen[v.Name] = true
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// enclosingEntity returns the kind of the innermost entity that is still open at
+// the end of src. Top-level declarations belong to the root directory.
+func enclosingEntity(src string) parse.TokenKind {
+	var stack []parse.TokenKind
+	expectHead := false
+	for _, t := range parse.Tokens([]byte(src)) {
+		switch t.Kind {
+		case parse.LParenTokenKind:
+			stack = append(stack, "")
+			expectHead = true
+			continue
+		case parse.RParenTokenKind:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case parse.NewlineTokenKind, parse.CommentTokenKind:
+			continue
+		default:
+			if expectHead {
+				stack[len(stack)-1] = t.Kind
+			}
+		}
+		expectHead = false
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		switch stack[i] {
+		case parse.DirTokenKind, parse.FileTokenKind, parse.LinkTokenKind, parse.VarTokenKind:
+			return stack[i]
+		}
+	}
+	return parse.DirTokenKind
+}
+
+// declaredVars returns the variables declared in text, ignoring errors.
+func declaredVars(text string) []*mktree.Var {
+	i := &mktree.Interpreter{}
+	vars, _ := i.VarsFile(strings.NewReader(text), "")
+	return vars
+}
+
+// variableDoc returns the documentation for the named variable, in markdown.
+func variableDoc(text, name string) string {
+	if doc, ok := variableDocs[name]; ok {
+		return doc
+	}
+	for _, v := range declaredVars(text) {
+		if v.Name != name {
+			continue
+		}
+		doc := v.Doc
+		if v.HasDefault {
+			doc = strings.TrimSpace(fmt.Sprintf("%s\n\nDefault: `%q`", doc, v.Default))
+		}
+		return doc
+	}
+	return ""
+}
+
+//
+// Definition
+//
+
+func (s *Server) definition(uri string, pos Position) *Location {
+	text := s.docs[uri]
+	offset := positionToOffset(text, pos)
+	tree, _ := parse.Parse(strings.NewReader(text))
+	if tree == nil {
+		return nil
+	}
+
+	var path string
+	var isTemplate bool
+	var visit func(e *parse.SExpr)
+	visit = func(e *parse.SExpr) {
+		if isFileRef(e.Literal.Token) && len(e.Args) > 0 && e.Args[0].Literal != nil {
+			t := e.Args[0].Token
+			if t.Pos <= offset && offset < t.End {
+				path = t.Value
+				isTemplate = e.Literal.Token.Value == "@template"
+			}
+		}
+		for _, a := range e.Args {
+			if a.SExpr != nil {
+				visit(a.SExpr)
+			}
+		}
+	}
+	for _, e := range tree.SExprs {
+		visit(e)
+	}
+	if path == "" {
+		return nil
+	}
+
+	if isTemplate {
+		i := &mktree.Interpreter{TemplatePath: s.TemplatePath}
+		found, ok := i.FindTemplate(uriToPath(uri), path)
+		if !ok {
+			return nil
+		}
+		return &Location{URI: pathToURI(found)}
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(uriToPath(uri)), path)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+	return &Location{URI: pathToURI(path)}
+}
+
+// isFileRef reports whether t is the head of an s-expression whose argument names
+// a file relative to the document.
+func isFileRef(t *parse.Token) bool {
+	return t.Value == "@template" || t.Kind == parse.IncludeTokenKind || t.Kind == parse.ImportTokenKind
+}
+
+//
+// Positions
+//
+
+// offsetToPosition converts a byte offset in text to an LSP position.
+func offsetToPosition(text string, offset int) Position {
+	if offset > len(text) {
+		offset = len(text)
+	}
+	before := text[:offset]
+	line := strings.Count(before, "\n")
+	lineStart := strings.LastIndexByte(before, '\n') + 1
+	return Position{Line: line, Character: len(utf16.Encode([]rune(text[lineStart:offset])))}
+}
+
+// positionToOffset converts an LSP position to a byte offset in text.
+func positionToOffset(text string, pos Position) int {
+	offset := 0
+	for i := 0; i < pos.Line; i++ {
+		n := strings.IndexByte(text[offset:], '\n')
+		if n < 0 {
+			return len(text)
+		}
+		offset += n + 1
+	}
+	for units := 0; units < pos.Character && offset < len(text) && text[offset] != '\n'; {
+		r, size := utf8.DecodeRuneInString(text[offset:])
+		units += len(utf16.Encode([]rune{r}))
+		offset += size
+	}
+	return offset
+}
+
+func uriToPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return filepath.FromSlash(u.Path)
+}
+
+func pathToURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
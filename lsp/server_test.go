@@ -0,0 +1,217 @@
+package lsp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// session runs s over the given client messages and returns the server's
+// messages, keyed by request id or, for notifications, by method.
+func session(t *testing.T, s *Server, messages ...string) map[string]json.RawMessage {
+	t.Helper()
+	var in bytes.Buffer
+	for _, m := range messages {
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(m), m)
+	}
+	var out bytes.Buffer
+	if err := s.Serve(&in, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]json.RawMessage{}
+	c := newConn(&out, nil)
+	for {
+		body, err := c.read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg struct {
+			ID     *int            `json:"id"`
+			Method string          `json:"method"`
+			Result json.RawMessage `json:"result"`
+			Params json.RawMessage `json:"params"`
+		}
+		if err := json.Unmarshal(body, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.ID != nil {
+			got[fmt.Sprint(*msg.ID)] = msg.Result
+		} else {
+			got[msg.Method] = msg.Params
+		}
+	}
+	return got
+}
+
+func didOpen(uri, text string) string {
+	b, _ := json.Marshal(text)
+	return fmt.Sprintf(`{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":%q,"languageId":"mktree","version":1,"text":%s}}}`, uri, b)
+}
+
+func positionRequest(id int, method, uri string, line, char int) string {
+	return fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":%q,"params":{"textDocument":{"uri":%q},"position":{"line":%d,"character":%d}}}`, id, method, uri, line, char)
+}
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mktree-lsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.tmpl"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	uri := pathToURI(filepath.Join(dir, "layout.tree"))
+	text := strings.Join([]string{
+		`(var "project" (@doc "The project.")) (dir "%(name)/%(project)"`,
+		`    (file "a" (@template "a.tmpl"))`,
+		`    (file "b" (@perms 755))`,
+		`    (file "c" (@))`,
+		`    (link "a" "l" (@))`,
+		`    (@)`,
+		`    (file "%(`,
+	}, "\n")
+
+	got := session(t, &Server{},
+		`{"jsonrpc":"2.0","id":0,"method":"initialize","params":{}}`,
+		didOpen(uri, text),
+		positionRequest(1, "textDocument/hover", uri, 0, 40),
+		positionRequest(2, "textDocument/hover", uri, 1, 16),
+		positionRequest(3, "textDocument/completion", uri, 3, 16),
+		positionRequest(4, "textDocument/completion", uri, 4, 20),
+		positionRequest(5, "textDocument/completion", uri, 5, 6),
+		positionRequest(6, "textDocument/completion", uri, 6, 14),
+		positionRequest(7, "textDocument/definition", uri, 1, 26),
+		positionRequest(9, "textDocument/hover", uri, 0, 55),
+		`{"jsonrpc":"2.0","id":8,"method":"shutdown"}`,
+		`{"jsonrpc":"2.0","method":"exit"}`,
+	)
+
+	t.Run("diagnostics", func(t *testing.T) {
+		var params publishDiagnosticsParams
+		if err := json.Unmarshal(got["textDocument/publishDiagnostics"], &params); err != nil {
+			t.Fatal(err)
+		}
+		if len(params.Diagnostics) == 0 {
+			t.Fatalf("wanted diagnostics for %q", text)
+		}
+	})
+
+	t.Run("hover", func(t *testing.T) {
+		for _, id := range []string{"1", "2", "9"} {
+			var h hover
+			if err := json.Unmarshal(got[id], &h); err != nil {
+				t.Fatal(err)
+			}
+			if h.Contents.Value == "" {
+				t.Errorf("request %s: wanted hover contents", id)
+			}
+		}
+	})
+
+	t.Run("completion", func(t *testing.T) {
+		want := map[string][]string{
+			"3": {"@contents", "@data", "@exists", "@perms", "@template"},
+			"4": {"@exists", "@symbolic"},
+			"5": {"@exists", "@perms"},
+			"6": {"name", "project", "root_dir"},
+		}
+		for id, labels := range want {
+			var list completionList
+			if err := json.Unmarshal(got[id], &list); err != nil {
+				t.Fatal(err)
+			}
+			var gotLabels []string
+			for _, item := range list.Items {
+				gotLabels = append(gotLabels, item.Label)
+			}
+			if diff := cmp.Diff(labels, gotLabels); diff != "" {
+				t.Errorf("request %s: got completion diff (+got,-want):\n%s\n", id, diff)
+			}
+		}
+	})
+
+	t.Run("definition", func(t *testing.T) {
+		var loc Location
+		if err := json.Unmarshal(got["7"], &loc); err != nil {
+			t.Fatal(err)
+		}
+		if want := pathToURI(filepath.Join(dir, "a.tmpl")); loc.URI != want {
+			t.Fatalf("got definition %q but wanted %q", loc.URI, want)
+		}
+	})
+}
+
+func TestServer_DefinitionInTemplatePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mktree-lsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	shared := filepath.Join(dir, "shared")
+	if err := os.Mkdir(shared, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(shared, "a.tmpl"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	uri := pathToURI(filepath.Join(dir, "src", "layout.tree"))
+	got := session(t, &Server{TemplatePath: []string{shared}},
+		`{"jsonrpc":"2.0","id":0,"method":"initialize","params":{}}`,
+		didOpen(uri, `(file "a" (@template "a.tmpl"))`),
+		positionRequest(1, "textDocument/definition", uri, 0, 23),
+		`{"jsonrpc":"2.0","method":"exit"}`,
+	)
+	var loc Location
+	if err := json.Unmarshal(got["1"], &loc); err != nil {
+		t.Fatal(err)
+	}
+	if want := pathToURI(filepath.Join(shared, "a.tmpl")); loc.URI != want {
+		t.Fatalf("got definition %q but wanted %q", loc.URI, want)
+	}
+}
+
+func TestServer_DiagnosticsInIncludedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mktree-lsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	inc := filepath.Join(dir, "inc.tree")
+	if err := ioutil.WriteFile(inc, []byte("(file \"a\")\n(file \"b\" (@perms ~))"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	uri := pathToURI(filepath.Join(dir, "layout.tree"))
+	got := session(t, &Server{},
+		`{"jsonrpc":"2.0","id":0,"method":"initialize","params":{}}`,
+		didOpen(uri, "(dir \"d\")\n(include \"inc.tree\")"),
+		`{"jsonrpc":"2.0","method":"exit"}`,
+	)
+	var params publishDiagnosticsParams
+	if err := json.Unmarshal(got["textDocument/publishDiagnostics"], &params); err != nil {
+		t.Fatal(err)
+	}
+	if len(params.Diagnostics) != 1 {
+		t.Fatalf("got diagnostics %v, want one", params.Diagnostics)
+	}
+	d := params.Diagnostics[0]
+	if d.Range != (Range{}) || !strings.HasPrefix(d.Message, inc+":2:") {
+		t.Errorf("got diagnostic %v, want it at the start of the document with the location in %s", d, inc)
+	}
+}
@@ -0,0 +1,377 @@
+package mktree
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The maximum number of symbolic links followed when resolving a path.
+const maxSymlinks = 40
+
+// MemFS is an FS that keeps its entries in memory. It is intended for testing
+// layouts without touching the disk.
+//
+// The zero value is an empty filesystem in which the current directory "." and
+// the root directory exist. Symbolic links are only followed when they are the
+// last element of a path.
+type MemFS struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode
+}
+
+var _ FS = (*MemFS)(nil)
+
+type memNode struct {
+	mode   fs.FileMode
+	data   []byte // The contents of a regular file.
+	target string // The target of a symbolic link.
+}
+
+type memFileInfo struct {
+	name string
+	node *memNode
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Mode() fs.FileMode  { return fi.node.mode }
+func (fi *memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi *memFileInfo) IsDir() bool        { return fi.node.mode.IsDir() }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
+
+func (fi *memFileInfo) Size() int64 {
+	if fi.node.mode&fs.ModeSymlink != 0 {
+		return int64(len(fi.node.target))
+	}
+	return int64(len(fi.node.data))
+}
+
+// Paths returns the names of all entries in sorted order, excluding "." and the
+// root directory.
+func (m *MemFS) Paths() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.init()
+
+	var names []string
+	for name := range m.nodes {
+		if !isMemRoot(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *MemFS) Lstat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lstat("lstat", name)
+}
+
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name, err := m.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return m.lstat("stat", name)
+}
+
+func (m *MemFS) SameFile(fi1, fi2 fs.FileInfo) bool {
+	a, ok1 := fi1.(*memFileInfo)
+	b, ok2 := fi2.(*memFileInfo)
+	return ok1 && ok2 && a.node == b.node
+}
+
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name, err := m.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	n, err := m.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if n.mode.IsDir() {
+		return nil, pathError("read", name, syscall.EISDIR)
+	}
+	return append([]byte(nil), n.data...), nil
+}
+
+func (m *MemFS) Readlink(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.lookup("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	if n.mode&fs.ModeSymlink == 0 {
+		return "", pathError("readlink", name, syscall.EINVAL)
+	}
+	return n.target, nil
+}
+
+func (m *MemFS) Mkdir(name string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.create("mkdir", name, &memNode{mode: fs.ModeDir | perm&memPermBits})
+}
+
+func (m *MemFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name, err := m.resolve("open", name)
+	if err != nil && !isNotExist(err) {
+		return err
+	}
+	data = append([]byte(nil), data...)
+	if n, err := m.lookup("open", name); err == nil {
+		if !n.mode.IsRegular() {
+			return pathError("open", name, syscall.EISDIR)
+		}
+		n.data, n.mode = data, perm&memPermBits
+		return nil
+	}
+	return m.create("open", name, &memNode{mode: perm & memPermBits, data: data})
+}
+
+func (m *MemFS) Chmod(name string, mode fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name, err := m.resolve("chmod", name)
+	if err != nil {
+		return err
+	}
+	n, err := m.lookup("chmod", name)
+	if err != nil {
+		return err
+	}
+	n.mode = n.mode&fs.ModeType | mode&memPermBits
+	return nil
+}
+
+func (m *MemFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	n, err := m.lookup("rename", oldpath)
+	if err != nil {
+		return err
+	}
+	if err := m.checkParent("rename", newpath); err != nil {
+		return err
+	}
+	if existing, ok := m.nodes[newpath]; ok {
+		if existing.mode.IsDir() && (!n.mode.IsDir() || m.hasChildren(newpath)) {
+			return pathError("rename", newpath, syscall.EEXIST)
+		}
+		if !existing.mode.IsDir() && n.mode.IsDir() {
+			return pathError("rename", newpath, syscall.ENOTDIR)
+		}
+	}
+	if n.mode.IsDir() && strings.HasPrefix(newpath, oldpath+string(filepath.Separator)) {
+		return pathError("rename", newpath, syscall.EINVAL)
+	}
+
+	for name, child := range m.nodes {
+		if rel, ok := m.under(oldpath, name); ok {
+			delete(m.nodes, name)
+			m.nodes[filepath.Join(newpath, rel)] = child
+		}
+	}
+	delete(m.nodes, oldpath)
+	m.nodes[newpath] = n
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	if _, err := m.lookup("remove", name); err != nil {
+		return err
+	}
+	if isMemRoot(name) {
+		return pathError("remove", name, syscall.EBUSY)
+	}
+	if m.hasChildren(name) {
+		return pathError("remove", name, syscall.ENOTEMPTY)
+	}
+	delete(m.nodes, name)
+	return nil
+}
+
+func (m *MemFS) RemoveAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.init()
+	name = filepath.Clean(name)
+	if isMemRoot(name) {
+		return pathError("unlinkat", name, syscall.EBUSY)
+	}
+	for child := range m.nodes {
+		if _, ok := m.under(name, child); ok {
+			delete(m.nodes, child)
+		}
+	}
+	delete(m.nodes, name)
+	return nil
+}
+
+func (m *MemFS) Link(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.lookup("link", oldname)
+	if err != nil {
+		return err
+	}
+	if n.mode.IsDir() {
+		return pathError("link", oldname, syscall.EPERM)
+	}
+	return m.create("link", newname, n)
+}
+
+func (m *MemFS) Symlink(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.create("symlink", newname, &memNode{mode: fs.ModeSymlink | 0777, target: oldname})
+}
+
+// The mode bits that can be set with Chmod.
+const memPermBits = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
+func (m *MemFS) init() {
+	if m.nodes == nil {
+		m.nodes = map[string]*memNode{
+			".":                        {mode: fs.ModeDir | 0777},
+			string(filepath.Separator): {mode: fs.ModeDir | 0777},
+		}
+	}
+}
+
+func (m *MemFS) lstat(op, name string) (fs.FileInfo, error) {
+	n, err := m.lookup(op, name)
+	if err != nil {
+		return nil, err
+	}
+	return &memFileInfo{name: filepath.Base(name), node: n}, nil
+}
+
+// lookup returns the node with the given name.
+func (m *MemFS) lookup(op, name string) (*memNode, error) {
+	m.init()
+	name = filepath.Clean(name)
+	if err := m.checkParent(op, name); err != nil {
+		return nil, err
+	}
+	n, ok := m.nodes[name]
+	if !ok {
+		return nil, pathError(op, name, fs.ErrNotExist)
+	}
+	return n, nil
+}
+
+// checkParent returns an error unless the parent of name is a directory.
+func (m *MemFS) checkParent(op, name string) error {
+	m.init()
+	if isMemRoot(name) {
+		return nil
+	}
+	var dirs []string
+	for dir := filepath.Dir(name); !isMemRoot(dir); dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		n, ok := m.nodes[dirs[i]]
+		if !ok {
+			return pathError(op, name, fs.ErrNotExist)
+		}
+		if !n.mode.IsDir() {
+			return pathError(op, name, syscall.ENOTDIR)
+		}
+	}
+	return nil
+}
+
+// create adds n under the given name, which must not exist.
+func (m *MemFS) create(op, name string, n *memNode) error {
+	name = filepath.Clean(name)
+	if err := m.checkParent(op, name); err != nil {
+		return err
+	}
+	if _, ok := m.nodes[name]; ok {
+		return pathError(op, name, fs.ErrExist)
+	}
+	m.nodes[name] = n
+	return nil
+}
+
+// resolve follows the symbolic link at name, if any, and returns the name of the
+// entry it refers to.
+func (m *MemFS) resolve(op, name string) (string, error) {
+	name = filepath.Clean(name)
+	for i := 0; i < maxSymlinks; i++ {
+		n, err := m.lookup(op, name)
+		if err != nil {
+			return name, err
+		}
+		if n.mode&fs.ModeSymlink == 0 {
+			return name, nil
+		}
+		target := n.target
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(name), target)
+		}
+		name = target
+	}
+	return "", pathError(op, name, syscall.ELOOP)
+}
+
+// under reports whether name is inside dir, and if so returns its path
+// relative to dir.
+func (m *MemFS) under(dir, name string) (string, bool) {
+	if dir == name {
+		return "", false
+	}
+	if dir == "." {
+		return name, !filepath.IsAbs(name)
+	}
+	prefix := dir + string(filepath.Separator)
+	if dir == string(filepath.Separator) {
+		prefix = dir
+	}
+	if !strings.HasPrefix(name, prefix) {
+		return "", false
+	}
+	return name[len(prefix):], true
+}
+
+func (m *MemFS) hasChildren(dir string) bool {
+	for name := range m.nodes {
+		if _, ok := m.under(dir, name); ok && !isMemRoot(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func isMemRoot(name string) bool {
+	return name == "." || name == string(filepath.Separator)
+}
+
+func isNotExist(err error) bool {
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+func pathError(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
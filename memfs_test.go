@@ -0,0 +1,85 @@
+package mktree
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMemFS(t *testing.T) {
+	m := &MemFS{}
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	must(m.Mkdir("a", 0755|os.ModeDir))
+	must(m.Mkdir("a/b", 0700|os.ModeDir))
+	must(m.WriteFile("a/b/c", []byte("hello"), 0644))
+	must(m.Symlink("b/c", "a/s"))
+	must(m.Link("a/b/c", "a/h"))
+
+	assertDir(t, m, "a/b", 0700|os.ModeDir)
+	assertFile(t, m, "a/s", 0644, "hello")
+	assertLink(t, m, "a/b/c", "a/s")
+	assertLink(t, m, "a/b/c", "a/h")
+
+	// Writing through a link changes the target.
+	must(m.WriteFile("a/s", []byte("goodbye"), 0600))
+	assertFile(t, m, "a/h", 0600, "goodbye")
+
+	must(m.Rename("a/b", "d"))
+	if diff := cmp.Diff([]string{"a", "a/h", "a/s", "d", "d/c"}, m.Paths()); diff != "" {
+		t.Errorf("got unexpected paths after rename (-want,+got):\n%s", diff)
+	}
+	if _, err := m.Stat("a/s"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of dangling link: got %v, want %v", err, fs.ErrNotExist)
+	}
+
+	if err := m.Remove("d"); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Errorf("Remove of non-empty dir: got %v, want %v", err, syscall.ENOTEMPTY)
+	}
+	must(m.RemoveAll("d"))
+	if err := m.WriteFile("a/h/x", nil, 0644); !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("WriteFile under a file: got %v, want %v", err, syscall.ENOTDIR)
+	}
+	if err := m.Mkdir("a", 0755|os.ModeDir); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Mkdir of existing dir: got %v, want %v", err, fs.ErrExist)
+	}
+	if diff := cmp.Diff([]string{"a", "a/h", "a/s"}, m.Paths()); diff != "" {
+		t.Errorf("got unexpected paths after remove (-want,+got):\n%s", diff)
+	}
+}
+
+func TestInterpreter_ExecFile_MemFS(t *testing.T) {
+	m := &MemFS{}
+	source := `
+(dir "a" (@perms 0700)
+	(file "b" (@contents "hello")))
+(link "a/b" "c" (@symbolic))
+`
+	i := &Interpreter{Root: "/root"}
+	if err := i.ExecFile(strings.NewReader(source), "", WithFS(m)); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"/root", "/root/a", "/root/a/b", "/root/c"}, m.Paths()); diff != "" {
+		t.Errorf("got unexpected paths (-want,+got):\n%s", diff)
+	}
+	assertDir(t, m, "/root/a", 0700|os.ModeDir)
+	assertFile(t, m, "/root/c", defaultFileMode, "hello")
+
+	// Transactions are rolled back in the FS.
+	i = &Interpreter{Root: "/root", Transactional: true}
+	source = `(file "a/b" (@contents "goodbye")) (link "missing" "d")`
+	if err := i.ExecFile(strings.NewReader(source), "", WithFS(m)); err == nil {
+		t.Fatal("expected an error but got nil")
+	}
+	assertFile(t, m, "/root/a/b", defaultFileMode, "hello")
+}
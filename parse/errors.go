@@ -3,6 +3,7 @@ package parse
 import (
 	"errors"
 	"fmt"
+	"strings"
 )
 
 var ErrSyntax = errors.New("syntax error")
@@ -11,3 +12,104 @@ var ErrParse = errors.New("parse error")
 func Errorf(kind error, format string, args ...interface{}) error {
 	return fmt.Errorf("%w: "+format, append([]interface{}{kind}, args...)...)
 }
+
+// Diagnostic codes.
+const (
+	CodeInvalidCharacter   = "invalid-character"
+	CodeInvalidEscape      = "invalid-escape"
+	CodeInvalidReference   = "invalid-reference"
+	CodeUnexpectedEOF      = "unexpected-eof"
+	CodeUnexpectedToken    = "unexpected-token"
+	CodeUnterminatedString = "unterminated-string"
+)
+
+// Severity is the severity of a Diagnostic.
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// Diagnostic describes a problem found in the source.
+type Diagnostic struct {
+	Filename string // The source filename, if known.
+	Line     int    // 1-based line number.
+	Column   int    // 1-based column number, in bytes.
+	Start    int    // Byte offset of the start of the problem.
+	End      int    // Byte offset immediately after the end of the problem.
+	Severity Severity
+	Code     string // A short, stable identifier for the kind of problem.
+	Message  string
+
+	// Kind is the class of error, such as ErrSyntax or ErrParse.
+	Kind error
+
+	context string // The source line with a caret pointing at the problem.
+}
+
+// NewDiagnostic returns an error Diagnostic for the bytes of src in [start, end).
+func NewDiagnostic(filename string, src []byte, start, end int, kind error, code, message string) Diagnostic {
+	line, col := Position(src, start)
+	return Diagnostic{
+		Filename: filename,
+		Line:     line,
+		Column:   col,
+		Start:    start,
+		End:      end,
+		Severity: SeverityError,
+		Code:     code,
+		Message:  message,
+		Kind:     kind,
+		context:  errorContext(src, start),
+	}
+}
+
+func (d Diagnostic) Error() string {
+	var b strings.Builder
+	if d.Filename != "" {
+		fmt.Fprintf(&b, "%s:", d.Filename)
+	}
+	fmt.Fprintf(&b, "%d:%d: %v: %s", d.Line, d.Column, d.Kind, d.Message)
+	if d.context != "" {
+		fmt.Fprintf(&b, "\n%s", d.context)
+	}
+	return b.String()
+}
+
+func (d Diagnostic) Unwrap() error {
+	return d.Kind
+}
+
+// Diagnostics is the error returned by the Parser when the source contains errors.
+//
+// Callers can retrieve every problem found in the source with errors.As.
+type Diagnostics []Diagnostic
+
+func (ds Diagnostics) Error() string {
+	ss := make([]string, 0, len(ds))
+	for _, d := range ds {
+		ss = append(ss, d.Error())
+	}
+	return strings.Join(ss, "\n")
+}
+
+// Is reports whether any of the diagnostics matches target.
+func (ds Diagnostics) Is(target error) bool {
+	for _, d := range ds {
+		if errors.Is(d, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,398 @@
+package parse
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The number of spaces used to indent the children of an s-expression.
+const indentWidth = 4
+
+// Format parses src and returns it in canonical form.
+//
+// Each entity is printed on its own line and indented by its depth in the tree.
+// Entities that only have attributes are printed on a single line, and the
+// attributes of consecutive single-line entities are aligned. Comments and single
+// blank lines are preserved.
+func Format(src []byte) ([]byte, error) {
+	t, err := Parse(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := Fprint(&b, t); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Fprint writes the canonical form of t to w.
+func Fprint(w io.Writer, t *Tree) error {
+	pr := &printer{}
+	args := make([]*Arg, 0, len(t.SExprs))
+	for _, e := range t.SExprs {
+		args = append(args, &Arg{SExpr: e})
+	}
+	pr.block(args, t.EndComments, 0)
+	if pr.b.Len() > 0 {
+		pr.b.WriteByte('\n')
+	}
+	_, err := w.Write(pr.b.Bytes())
+	return err
+}
+
+type printer struct {
+	b       bytes.Buffer
+	comment bool // Whether the current line ends with a comment.
+}
+
+func (pr *printer) write(s string) {
+	pr.b.WriteString(s)
+	pr.comment = false
+}
+
+// line starts a new line at the given indentation.
+func (pr *printer) line(indent int) {
+	if pr.b.Len() > 0 {
+		pr.b.WriteByte('\n')
+	}
+	pr.write(strings.Repeat(" ", indent))
+}
+
+func (pr *printer) writeComment(c *Comment) {
+	pr.write(strings.TrimRightFunc(c.Token.Value, unicode.IsSpace))
+	pr.comment = true
+}
+
+// block prints each arg on its own line, followed by any trailing comments.
+func (pr *printer) block(args []*Arg, end []*Comment, indent int) {
+	started := false
+	blank := func(b bool) {
+		if b && started {
+			pr.b.WriteByte('\n')
+		}
+	}
+
+	pad := alignment(args)
+	for i, a := range args {
+		c := argComments(a)
+		for _, cm := range c.Before {
+			blank(cm.Blank)
+			pr.line(indent)
+			pr.writeComment(cm)
+			started = true
+		}
+		blank(c.Blank)
+		pr.line(indent)
+		if a.SExpr != nil {
+			pr.sexpr(a.SExpr, indent, pad[i])
+		} else {
+			pr.literal(a.Literal, indent)
+		}
+		started = true
+	}
+	for _, cm := range end {
+		blank(cm.Blank)
+		pr.line(indent)
+		pr.writeComment(cm)
+		started = true
+	}
+}
+
+// sexpr prints e starting at the current position. If pad is non-zero, the
+// arguments following the leading literals of a single-line s-expression are
+// aligned to that column.
+func (pr *printer) sexpr(e *SExpr, indent, pad int) {
+	if isInline(e) {
+		prefix := inlinePrefix(e)
+		pr.write(prefix)
+		if n := pad - utf8.RuneCountInString(prefix); n > 0 {
+			pr.write(strings.Repeat(" ", n))
+		}
+		for _, a := range e.Args[leadingLiterals(e):] {
+			pr.write(" ")
+			pr.inlineArg(a, indent)
+		}
+		pr.write(")")
+		pr.trailingComment(e.Comments.After)
+		return
+	}
+
+	pr.write("(")
+	if len(e.Literal.Comments.Before) > 0 {
+		for _, cm := range e.Literal.Comments.Before {
+			pr.line(indent + indentWidth)
+			pr.writeComment(cm)
+		}
+		pr.line(indent + indentWidth)
+	}
+	pr.write(e.Literal.Token.Value)
+	pr.trailingComment(e.Literal.Comments.After)
+
+	// Keep leading literal arguments, such as entity names, on the first line.
+	i := 0
+	for ; i < len(e.Args) && !pr.comment; i++ {
+		l := e.Args[i].Literal
+		if l == nil || len(l.Comments.Before) > 0 || l.Comments.Blank {
+			break
+		}
+		pr.write(" ")
+		pr.literal(l, indent)
+	}
+
+	pr.block(e.Args[i:], e.EndComments, indent+indentWidth)
+	if pr.comment {
+		pr.line(indent)
+	}
+	pr.write(")")
+	pr.trailingComment(e.Comments.After)
+}
+
+func (pr *printer) inlineArg(a *Arg, indent int) {
+	if a.Literal != nil {
+		pr.writeLiteral(a.Literal.Token, indent)
+		return
+	}
+	e := a.SExpr
+	pr.write(inlinePrefix(e))
+	for _, a := range e.Args[leadingLiterals(e):] {
+		pr.write(" ")
+		pr.inlineArg(a, indent)
+	}
+	pr.write(")")
+}
+
+func (pr *printer) literal(l *Literal, indent int) {
+	pr.writeLiteral(l.Token, indent)
+	pr.trailingComment(l.Comments.After)
+}
+
+func (pr *printer) writeLiteral(t *Token, indent int) {
+	if t.Kind != StringTokenKind {
+		pr.write(t.Value)
+		return
+	}
+	if t.Raw && canFormatRaw(t.Value) {
+		pr.write(formatRaw(t.Value, indent+indentWidth))
+		return
+	}
+	pr.write(formatQuoted(t.Value))
+}
+
+func (pr *printer) trailingComment(c *Comment) {
+	if c != nil {
+		pr.write(" ")
+		pr.writeComment(c)
+	}
+}
+
+// inlinePrefix returns the opening parenthesis, head and leading literals of e.
+func inlinePrefix(e *SExpr) string {
+	var b strings.Builder
+	b.WriteString("(")
+	b.WriteString(e.Literal.Token.Value)
+	for _, a := range e.Args[:leadingLiterals(e)] {
+		b.WriteString(" ")
+		if a.Literal.Token.Kind == StringTokenKind {
+			// Leading literals never span lines, so indentation is irrelevant.
+			if a.Literal.Token.Raw && canFormatRaw(a.Literal.Token.Value) {
+				b.WriteString(formatRaw(a.Literal.Token.Value, 0))
+			} else {
+				b.WriteString(formatQuoted(a.Literal.Token.Value))
+			}
+			continue
+		}
+		b.WriteString(a.Literal.Token.Value)
+	}
+	return b.String()
+}
+
+func leadingLiterals(e *SExpr) int {
+	n := 0
+	for n < len(e.Args) && e.Args[n].Literal != nil && !isMultiline(e.Args[n].Literal.Token) {
+		n++
+	}
+	return n
+}
+
+// alignment returns, for each arg, the column to which the arguments following
+// its leading literals should be aligned, or zero if no alignment is needed.
+//
+// Consecutive single-line s-expressions with attributes form a run, which is
+// broken by comments, blank lines or any other kind of arg.
+func alignment(args []*Arg) []int {
+	pad := make([]int, len(args))
+	alignable := func(a *Arg) bool {
+		e := a.SExpr
+		return e != nil && isInline(e) && leadingLiterals(e) < len(e.Args) && !hasMultiline(e)
+	}
+	for i := 0; i < len(args); {
+		if !alignable(args[i]) {
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(args) && alignable(args[j]) {
+			c := argComments(args[j])
+			if len(c.Before) > 0 || c.Blank {
+				break
+			}
+			j++
+		}
+		if j-i > 1 {
+			width := 0
+			for _, a := range args[i:j] {
+				if n := utf8.RuneCountInString(inlinePrefix(a.SExpr)); n > width {
+					width = n
+				}
+			}
+			for k := i; k < j; k++ {
+				pad[k] = width
+			}
+		}
+		i = j
+	}
+	return pad
+}
+
+// isInline reports whether e can be printed on a single line.
+//
+// This is true if e has no comments between its parentheses and all of its
+// s-expression arguments are attributes that can themselves be printed inline.
+// The arguments of attributes may be any s-expressions.
+func isInline(e *SExpr) bool {
+	return isInlineWithin(e, false)
+}
+
+func isInlineWithin(e *SExpr, inAttr bool) bool {
+	if len(e.EndComments) > 0 || hasComments(e.Literal.Comments) {
+		return false
+	}
+	inAttr = inAttr || e.Literal.Token.Kind == AttributeTokenKind
+	for i, a := range e.Args {
+		if a.Literal != nil {
+			if hasComments(a.Literal.Comments) || a.Literal.Comments.Blank {
+				return false
+			}
+			// Multiline strings may only end the line.
+			if isMultiline(a.Literal.Token) && i != len(e.Args)-1 {
+				return false
+			}
+			continue
+		}
+		s := a.SExpr
+		if hasComments(s.Comments) || s.Comments.Blank {
+			return false
+		}
+		if !inAttr && s.Literal.Token.Kind != AttributeTokenKind {
+			return false
+		}
+		if !isInlineWithin(s, inAttr) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasMultiline(e *SExpr) bool {
+	for _, a := range e.Args {
+		if a.Literal != nil && isMultiline(a.Literal.Token) || a.SExpr != nil && hasMultiline(a.SExpr) {
+			return true
+		}
+	}
+	return false
+}
+
+func isMultiline(t *Token) bool {
+	return t.Kind == StringTokenKind && t.Raw && canFormatRaw(t.Value) && strings.Contains(t.Value, "\n")
+}
+
+func hasComments(c Comments) bool {
+	return len(c.Before) > 0 || c.After != nil
+}
+
+func argComments(a *Arg) Comments {
+	if a.SExpr != nil {
+		return a.SExpr.Comments
+	}
+	return a.Literal.Comments
+}
+
+// canFormatRaw reports whether s can be written as a raw string and read back
+// unchanged.
+func canFormatRaw(s string) bool {
+	if s == "" || strings.Contains(s, `"""`) || strings.HasSuffix(s, `"`) {
+		return false
+	}
+	if !strings.Contains(s, "\n") {
+		return true
+	}
+	lines := strings.Split(s, "\n")
+	unindented := false
+	for _, line := range lines {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" && line != "" {
+			return false // Whitespace-only lines are not preserved.
+		}
+		if trimmed != "" && trimmed == line {
+			unindented = true
+		}
+	}
+	// Without a trailing newline, the closing delimiter does not anchor the
+	// indentation, so at least one line must start at the margin.
+	return unindented || strings.HasSuffix(s, "\n")
+}
+
+// formatRaw formats s as a raw string whose lines are indented to the given column.
+func formatRaw(s string, indent int) string {
+	if !strings.Contains(s, "\n") {
+		return `"""` + s + `"""`
+	}
+
+	margin := strings.Repeat(" ", indent)
+	lines := strings.Split(s, "\n")
+	var b strings.Builder
+	b.WriteString(`"""`)
+	for _, line := range lines[:len(lines)-1] {
+		b.WriteByte('\n')
+		if line != "" {
+			b.WriteString(margin + line)
+		}
+	}
+	b.WriteByte('\n')
+	b.WriteString(margin + lines[len(lines)-1])
+	b.WriteString(`"""`)
+	return b.String()
+}
+
+// formatQuoted formats s as a double-quoted string, escaping characters as needed.
+func formatQuoted(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for len(s) > 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		switch {
+		case r == utf8.RuneError && size == 1:
+			b.WriteByte(s[0]) // Preserve invalid UTF-8 as-is.
+		case r == '"':
+			b.WriteString(`\"`)
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case !unicode.IsPrint(r) && r != ' ':
+			fmt.Fprintf(&b, `\u{%X}`, r)
+		default:
+			b.WriteRune(r)
+		}
+		s = s[size:]
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,126 @@
+package parse
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			name:   "one_entity_per_line",
+			source: `(dir "a") (file "b" (@perms 0644)) (link "b" "c")`,
+			want: `
+(dir "a")
+(file "b" (@perms 0644))
+(link "b" "c")
+`,
+		},
+		{
+			name: "children_are_indented",
+			source: `(dir "a" (@perms 0755) (dir "b"
+  (file "c")))`,
+			want: `
+(dir "a"
+    (@perms 0755)
+    (dir "b"
+        (file "c")))
+`,
+		},
+		{
+			name: "attributes_are_aligned",
+			source: `(dir "a"
+  (file "LICENSE" (@template "LICENSE.tmpl"))
+  (file "README.md"      (@template "README.md.tmpl"))
+
+  (file "main.c" (@template "main.c.tmpl")) (@perms 0700))`,
+			want: `
+(dir "a"
+    (file "LICENSE"   (@template "LICENSE.tmpl"))
+    (file "README.md" (@template "README.md.tmpl"))
+
+    (file "main.c" (@template "main.c.tmpl"))
+    (@perms 0700))
+`,
+		},
+		{
+			name: "comments_are_preserved",
+			source: `
+; header
+
+
+; details
+(dir "a" ; the dir
+  ; leading
+  (file "b") ; trailing
+  ; dangling
+  )
+; footer`,
+			want: `
+; header
+
+; details
+(dir "a" ; the dir
+    ; leading
+    (file "b") ; trailing
+    ; dangling
+)
+; footer
+`,
+		},
+		{
+			name:   "strings_are_escaped",
+			source: `(file "a\tb" (@contents "\u{22}quoted\u{22}\n"))`,
+			want: `
+(file "a\tb" (@contents "\"quoted\"\n"))
+`,
+		},
+		{
+			name: "raw_strings_are_reindented",
+			source: `(dir "a" (file "b" (@contents """
+  #!/bin/sh
+    echo "hi"
+  """)))`,
+			want: `
+(dir "a"
+    (file "b" (@contents """
+        #!/bin/sh
+          echo "hi"
+        """)))
+`,
+		},
+		{
+			name:   "variables_are_preserved",
+			source: `(file "%(name)" (@perms %(perms)))`,
+			want: `
+(file "%(name)" (@perms %(perms)))
+`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Format([]byte(test.source))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := strings.TrimPrefix(test.want, "\n")
+			if diff := cmp.Diff(want, string(got)); diff != "" {
+				t.Fatalf("Format(`%s`) got diff (+got,-want):\n%s\n", test.source, diff)
+			}
+
+			again, err := Format(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(string(got), string(again)); diff != "" {
+				t.Fatalf("Format is not idempotent for `%s` (+got,-want):\n%s\n", test.source, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package parse
+
+import (
+	"errors"
+	"strings"
+)
+
+//
+// Interpolation
+//
+// Strings refer to variables as %(name). Whitespace around the name is ignored.
+// A literal %( is written as %%(.
+//
+
+// Reference is a reference to a variable in a string.
+type Reference struct {
+	Name  string
+	Start int // Byte offset of the reference's leading '%'.
+	End   int // Byte offset immediately after the reference's closing ')'.
+}
+
+// References returns the variable references in s, in order.
+func References(s string) ([]Reference, error) {
+	var refs []Reference
+	err := scanReferences(s, func(r Reference) (string, error) {
+		refs = append(refs, r)
+		return "", nil
+	}, nil)
+	return refs, err
+}
+
+// Interpolate returns s with each variable reference replaced by the value
+// returned by lookup and each %%( replaced by %(. It returns the first error
+// returned by lookup.
+func Interpolate(s string, lookup func(name string) (string, error)) (string, error) {
+	var b strings.Builder
+	err := scanReferences(s, func(r Reference) (string, error) {
+		return lookup(r.Name)
+	}, &b)
+	return b.String(), err
+}
+
+// EscapeReferences returns s with each %( escaped as %%(, so that s is the
+// result of interpolating the returned string.
+func EscapeReferences(s string) string {
+	return strings.ReplaceAll(s, "%(", "%%(")
+}
+
+// scanReferences calls replace for each reference in s and writes s to b, if b
+// is not nil, with each reference replaced by the result.
+func scanReferences(s string, replace func(Reference) (string, error), b *strings.Builder) error {
+	write := func(s string) {
+		if b != nil {
+			b.WriteString(s)
+		}
+	}
+	for i := 0; i < len(s); {
+		switch {
+		case strings.HasPrefix(s[i:], "%%("):
+			write("%(")
+			i += len("%%(")
+		case strings.HasPrefix(s[i:], "%("):
+			end := strings.IndexByte(s[i:], ')')
+			if end < 0 {
+				return errors.New("unterminated variable reference: expected ')'")
+			}
+			r := Reference{Name: strings.TrimSpace(s[i+len("%(") : i+end]), Start: i, End: i + end + 1}
+			if r.Name == "" {
+				return errors.New("empty variable reference '%()' is not allowed")
+			}
+			value, err := replace(r)
+			if err != nil {
+				return err
+			}
+			write(value)
+			i = r.End
+		default:
+			write(s[i : i+1])
+			i++
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package parse
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestInterpolate(t *testing.T) {
+	vars := map[string]string{"a": "one", "b": "%(a)"}
+	lookup := func(name string) (string, error) {
+		value, ok := vars[name]
+		if !ok {
+			return "", errors.New("undefined")
+		}
+		return value, nil
+	}
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{input: "", want: ""},
+		{input: "no references", want: "no references"},
+		{input: "%(a)", want: "one"},
+		{input: "x%( a )y%(a)z", want: "xoneyonez"},
+		{input: "%(b)", want: "%(a)"}, // Values are not interpolated.
+		{input: "%%(a)", want: "%(a)"},
+		{input: "%%%(a)", want: "%%(a)"},
+		{input: "100% (a)", want: "100% (a)"},
+		{input: "%(c)", wantErr: true},
+		{input: "%()", wantErr: true},
+		{input: "%(a", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := Interpolate(test.input, lookup)
+		if (err != nil) != test.wantErr {
+			t.Errorf("Interpolate(%q) got error %v, wantErr %v", test.input, err, test.wantErr)
+			continue
+		}
+		if err == nil && got != test.want {
+			t.Errorf("Interpolate(%q) = %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestReferences(t *testing.T) {
+	got, err := References("%(a)/%%(b)/%( c )")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Reference{{Name: "a", Start: 0, End: 4}, {Name: "c", Start: 11, End: 17}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("got unexpected references (-want,+got):\n%s", diff)
+	}
+}
+
+func TestEscapeReferences(t *testing.T) {
+	for _, s := range []string{"", "%(a)", "%%(a)", "%(%(", "100%"} {
+		got, err := Interpolate(EscapeReferences(s), func(string) (string, error) {
+			return "", errors.New("unexpected reference")
+		})
+		if err != nil || got != s {
+			t.Errorf("Interpolate(EscapeReferences(%q)) = %q, %v", s, got, err)
+		}
+	}
+}
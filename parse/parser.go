@@ -7,9 +7,9 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"os"
-	"runtime/debug"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 //
@@ -23,6 +23,8 @@ const (
 	CommentTokenKind   TokenKind = "Comment"
 	NumberTokenKind    TokenKind = "Number"
 	StringTokenKind    TokenKind = "String"
+	VariableTokenKind  TokenKind = "Variable"
+	IdentTokenKind     TokenKind = "Identifier"
 	LParenTokenKind    TokenKind = "LParen"
 	RParenTokenKind    TokenKind = "RParen"
 	NewlineTokenKind   TokenKind = "Newline"
@@ -30,21 +32,47 @@ const (
 	ErrTokenKind       TokenKind = "Error"
 
 	// Keywords
-	DirTokenKind  TokenKind = "dir"
-	FileTokenKind TokenKind = "file"
-	LinkTokenKind TokenKind = "link"
+	DefineTokenKind  TokenKind = "define"
+	DirTokenKind     TokenKind = "dir"
+	FileTokenKind    TokenKind = "file"
+	ForTokenKind     TokenKind = "for"
+	ImportTokenKind  TokenKind = "import"
+	IncludeTokenKind TokenKind = "include"
+	LinkTokenKind    TokenKind = "link"
+	UnlessTokenKind  TokenKind = "unless"
+	UseTokenKind     TokenKind = "use"
+	VarTokenKind     TokenKind = "var"
+	WhenTokenKind    TokenKind = "when"
 )
 
 var keywords = map[string]TokenKind{
-	"dir":  DirTokenKind,
-	"file": FileTokenKind,
-	"link": LinkTokenKind,
+	"define":  DefineTokenKind,
+	"dir":     DirTokenKind,
+	"file":    FileTokenKind,
+	"for":     ForTokenKind,
+	"import":  ImportTokenKind,
+	"include": IncludeTokenKind,
+	"link":    LinkTokenKind,
+	"unless":  UnlessTokenKind,
+	"use":     UseTokenKind,
+	"var":     VarTokenKind,
+	"when":    WhenTokenKind,
+}
+
+// IsKeyword reports whether k is the kind of a keyword.
+func IsKeyword(k TokenKind) bool {
+	_, ok := keywords[string(k)]
+	return ok
 }
 
 type Token struct {
 	Kind  TokenKind
 	Value string
-	Pos   int
+	Pos   int // Byte offset of the first character of the token.
+	End   int // Byte offset immediately after the last character of the token.
+
+	// Raw is true if this is a StringTokenKind token written as a raw string.
+	Raw bool
 }
 
 func (t Token) String() string {
@@ -53,15 +81,36 @@ func (t Token) String() string {
 
 type Tree struct {
 	SExprs []*SExpr
+
+	// Comments after the last s-expression.
+	EndComments []*Comment
 }
 
 type SExpr struct {
-	Literal *Literal
-	Args    []*Arg
+	Literal  *Literal
+	Args     []*Arg
+	Comments Comments
+
+	// Comments after the last argument, before the closing parenthesis.
+	EndComments []*Comment
 }
 
 type Literal struct {
+	Token    *Token
+	Comments Comments
+}
+
+// Comment is a comment in the source.
+type Comment struct {
 	Token *Token
+	Blank bool // Whether the comment is preceded by a blank line.
+}
+
+// Comments are the comments attached to a node.
+type Comments struct {
+	Before []*Comment // Comments on the lines before the node.
+	After  *Comment   // A comment on the same line after the node.
+	Blank  bool       // Whether the node is preceded by a blank line.
 }
 
 type Arg struct {
@@ -83,10 +132,16 @@ type Parser struct {
 	s []byte          // Original source.
 	r *bufio.Reader   // Buffered source reader.
 	p int             // Source position.
+	o int             // Start position of the current token.
 	t *Token          // Current token.
 	b strings.Builder // Current token source buffer.
-	e error           // Most recent error.
+	d Diagnostics     // Reported diagnostics.
+	m bool            // Whether the parser is recovering from an error.
 
+	// Filename is the name of the source file, used only in diagnostics.
+	Filename string
+
+	// Stderr, if set, receives a copy of every diagnostic as it is reported.
 	Stderr io.Writer
 }
 
@@ -94,15 +149,29 @@ func Parse(r io.Reader) (*Tree, error) {
 	return (&Parser{}).Parse(r)
 }
 
+// Tokens returns every token in src up to and including the EOF token. Comments and
+// newlines are included. Lexical errors are returned as ErrTokenKind tokens.
+func Tokens(src []byte) []*Token {
+	p := &Parser{}
+	p.init(bytes.NewReader(src))
+	var tokens []*Token
+	for {
+		nextToken(p)
+		tokens = append(tokens, p.t)
+		if match(p, EofTokenKind) {
+			return tokens
+		}
+	}
+}
+
 func (p *Parser) init(r io.Reader) error {
 	src, err := ioutil.ReadAll(r)
 	if err != nil {
 		return err
 	}
-	if p.Stderr == nil {
-		p.Stderr = os.Stderr
-	}
 	p.s = src
+	p.d = nil
+	p.m = false
 	p.r = bufio.NewReader(bytes.NewReader(p.s))
 	makeToken(p, EofTokenKind)
 	return nil
@@ -113,35 +182,69 @@ func (p *Parser) Parse(r io.Reader) (*Tree, error) {
 		return nil, err
 	}
 	c := parseConfig(p)
-	return c, p.e
+	if len(p.d) > 0 {
+		return c, p.d
+	}
+	return c, nil
 }
 
 func parseConfig(p *Parser) *Tree {
 	c := &Tree{}
 	nextToken(p)
-	for !match(p, EofTokenKind) {
-		ignore(p, CommentTokenKind, NewlineTokenKind)
-		c.SExprs = append(c.SExprs, parseSExpr(p))
-		ignore(p, CommentTokenKind, NewlineTokenKind)
+	for {
+		comments := parseComments(p)
+		if match(p, EofTokenKind) {
+			c.EndComments = comments.Before
+			break
+		}
+		if !match(p, LParenTokenKind) {
+			emitUnexpectedTokenError(p)
+			skipToSExpr(p)
+			continue
+		}
+		e := parseSExpr(p)
+		e.Comments.Before, e.Comments.Blank = comments.Before, comments.Blank
+		c.SExprs = append(c.SExprs, e)
 	}
 	return c
 }
 
 func parseSExpr(p *Parser) *SExpr {
 	consume(p, LParenTokenKind)
-	ignore(p, NewlineTokenKind)
 
+	comments := parseComments(p)
 	literal := parseLiteral(p)
-	ignore(p, NewlineTokenKind)
+	literal.Comments.Before = comments.Before
+	literal.Comments.After = parseTrailingComment(p)
 
-	var args []*Arg
-	for !(match(p, EofTokenKind) || match(p, RParenTokenKind)) {
-		args = append(args, parseArg(p))
-		ignore(p, NewlineTokenKind)
+	e := &SExpr{Literal: literal}
+	for {
+		comments := parseComments(p)
+		if match(p, EofTokenKind) || match(p, RParenTokenKind) {
+			e.EndComments = comments.Before
+			break
+		}
+		if p.m {
+			synchronize(p)
+			break
+		}
+		arg := parseArg(p)
+		if arg.SExpr != nil {
+			arg.SExpr.Comments.Before, arg.SExpr.Comments.Blank = comments.Before, comments.Blank
+		} else {
+			arg.Literal.Comments.Before, arg.Literal.Comments.Blank = comments.Before, comments.Blank
+		}
+		e.Args = append(e.Args, arg)
 	}
 
-	consume(p, RParenTokenKind)
-	return &SExpr{Literal: literal, Args: args}
+	if match(p, RParenTokenKind) {
+		nextToken(p)
+		p.m = false // Recovered.
+	} else {
+		emitUnexpectedTokenError(p)
+	}
+	e.Comments.After = parseTrailingComment(p)
+	return e
 }
 
 func parseArg(p *Parser) *Arg {
@@ -151,13 +254,18 @@ func parseArg(p *Parser) *Arg {
 		return &Arg{Token: t, SExpr: e}
 	}
 	l := parseLiteral(p)
+	l.Comments.After = parseTrailingComment(p)
 	return &Arg{Token: l.Token, Literal: l}
 }
 
 func parseLiteral(p *Parser) *Literal {
 	t := peekToken(p)
 	switch t.Kind {
-	case DirTokenKind, FileTokenKind, LinkTokenKind, AttributeTokenKind, StringTokenKind, NumberTokenKind:
+	case AttributeTokenKind, StringTokenKind, NumberTokenKind, VariableTokenKind, IdentTokenKind:
+		nextToken(p)
+		return &Literal{Token: t}
+	}
+	if IsKeyword(t.Kind) {
 		nextToken(p)
 		return &Literal{Token: t}
 	}
@@ -165,6 +273,35 @@ func parseLiteral(p *Parser) *Literal {
 	return &Literal{Token: t}
 }
 
+// parseComments consumes the comments and newlines preceding the next node.
+func parseComments(p *Parser) Comments {
+	var c Comments
+	newlines := 0
+	for {
+		switch peekToken(p).Kind {
+		case NewlineTokenKind:
+			newlines++
+		case CommentTokenKind:
+			c.Before = append(c.Before, &Comment{Token: peekToken(p), Blank: newlines > 1})
+			newlines = 0
+		default:
+			c.Blank = newlines > 1
+			return c
+		}
+		nextToken(p)
+	}
+}
+
+// parseTrailingComment consumes a comment on the same line as the preceding node.
+func parseTrailingComment(p *Parser) *Comment {
+	if !match(p, CommentTokenKind) {
+		return nil
+	}
+	c := &Comment{Token: peekToken(p)}
+	nextToken(p)
+	return c
+}
+
 func consume(p *Parser, k TokenKind) {
 	if match(p, k) {
 		nextToken(p)
@@ -173,14 +310,31 @@ func consume(p *Parser, k TokenKind) {
 	emitUnexpectedTokenError(p)
 }
 
-func ignore(p *Parser, kinds ...TokenKind) {
-OuterLoop:
-	for _, k := range kinds {
-		if match(p, k) {
-			nextToken(p)
-			goto OuterLoop
+// synchronize skips tokens until the parser reaches the closing parenthesis of the
+// current s-expression, so that parsing can resume after an error.
+func synchronize(p *Parser) {
+	depth := 0
+	for !match(p, EofTokenKind) {
+		switch peekToken(p).Kind {
+		case LParenTokenKind:
+			depth++
+		case RParenTokenKind:
+			if depth == 0 {
+				return
+			}
+			depth--
 		}
+		nextToken(p)
+	}
+}
+
+// skipToSExpr skips tokens until the parser reaches the start of the next top-level
+// s-expression.
+func skipToSExpr(p *Parser) {
+	for !(match(p, EofTokenKind) || match(p, LParenTokenKind)) {
+		nextToken(p)
 	}
+	p.m = false
 }
 
 //
@@ -199,13 +353,15 @@ func makeToken(p *Parser, k TokenKind) {
 	p.t = &Token{
 		Kind:  k,
 		Value: p.b.String(),
-		Pos:   p.p - p.b.Len(),
+		Pos:   p.o,
+		End:   p.p,
 	}
 	p.b.Reset()
 }
 
 func nextToken(p *Parser) {
 	for {
+		p.o = p.p
 		if isEOF(p.r) {
 			makeToken(p, EofTokenKind)
 			return
@@ -235,17 +391,20 @@ func nextToken(p *Parser) {
 		case ';':
 			readComment(p)
 			return
+		case '%':
+			readVariable(p)
+			return
 		}
 		if isDigit(peekChar(p.r)) {
 			readNumber(p)
 			return
 		}
-		if isAlpha(peekChar(p.r)) {
-			readKeyword(p)
+		if isIdentStart(peekChar(p.r)) {
+			readIdent(p)
 			return
 		}
-		emitSyntaxError(p, "invalid character %s", string(peekChar(p.r)))
-		skipChar(p)
+		nextChar(p)
+		emitSyntaxError(p, CodeInvalidCharacter, "invalid character %s", p.b.String())
 		return
 	}
 }
@@ -256,17 +415,198 @@ func readAttribute(p *Parser) {
 	makeToken(p, AttributeTokenKind)
 }
 
+// readVariable reads a variable reference outside of a string, which evaluates
+// to the variable's value as a string.
+func readVariable(p *Parser) {
+	nextChar(p) // %
+	if isEOF(p.r) || peekChar(p.r) != '(' {
+		emitSyntaxError(p, CodeInvalidCharacter, "invalid character %%")
+		return
+	}
+	readUntil(p, ')')
+	if isEOF(p.r) {
+		emitSyntaxError(p, CodeUnexpectedEOF, "unterminated variable")
+		return
+	}
+	nextChar(p) // )
+	if !checkReferences(p) {
+		return
+	}
+	makeToken(p, VariableTokenKind)
+}
+
+// checkReferences reports a syntax error and returns false if the token buffer
+// holds an invalid variable reference.
+func checkReferences(p *Parser) bool {
+	if _, err := References(p.b.String()); err != nil {
+		emitSyntaxError(p, CodeInvalidReference, "%v", err)
+		return false
+	}
+	return true
+}
+
 func readComment(p *Parser) {
 	readUntil(p, '\n')
 	makeToken(p, CommentTokenKind)
 }
 
-// TODO: Handle escaped quotes.
 func readString(p *Parser) {
+	if hasPrefix(p.r, rawStringDelim) {
+		readRawString(p)
+		return
+	}
+
 	skipChar(p) // "
-	readUntil(p, '"')
+	var escapeErr error
+	for {
+		if isEOF(p.r) {
+			emitSyntaxError(p, CodeUnterminatedString, "unterminated string")
+			return
+		}
+		switch peekChar(p.r) {
+		case '"':
+			skipChar(p)
+			if escapeErr != nil {
+				emitSyntaxError(p, CodeInvalidEscape, "%v", escapeErr)
+				return
+			}
+			if !checkReferences(p) {
+				return
+			}
+			makeToken(p, StringTokenKind)
+			return
+		case '\\':
+			if err := readEscape(p); err != nil && escapeErr == nil {
+				escapeErr = err
+			}
+		default:
+			nextChar(p)
+		}
+	}
+}
+
+// readEscape decodes the escape sequence at the current position into the token buffer.
+func readEscape(p *Parser) error {
+	skipChar(p) // \
+	if isEOF(p.r) {
+		return nil // Reported as an unterminated string.
+	}
+	switch c := skipChar(p); c {
+	case '"', '\\':
+		p.b.WriteByte(c)
+	case 'n':
+		p.b.WriteByte('\n')
+	case 't':
+		p.b.WriteByte('\t')
+	case 'u':
+		return readUnicodeEscape(p)
+	default:
+		return fmt.Errorf("invalid escape sequence \\%s", string(c))
+	}
+	return nil
+}
+
+// readUnicodeEscape decodes a \u{XXXX} escape sequence following the leading \u.
+func readUnicodeEscape(p *Parser) error {
+	if isEOF(p.r) || peekChar(p.r) != '{' {
+		return errors.New("invalid unicode escape: expected '{'")
+	}
+	skipChar(p) // {
+
+	var digits strings.Builder
+	for !isEOF(p.r) && isHexDigit(peekChar(p.r)) {
+		digits.WriteByte(skipChar(p))
+	}
+	if isEOF(p.r) || peekChar(p.r) != '}' {
+		return errors.New("invalid unicode escape: expected '}'")
+	}
+	skipChar(p) // }
+
+	n, err := strconv.ParseUint(digits.String(), 16, 32)
+	if err != nil || !utf8.ValidRune(rune(n)) {
+		return fmt.Errorf("invalid unicode escape \\u{%s}", digits.String())
+	}
+	p.b.WriteRune(rune(n))
+	return nil
+}
+
+const rawStringDelim = `"""`
+
+// readRawString reads a triple-quoted string.
+//
+// Raw strings do not support escape sequences. A newline directly after the opening
+// delimiter is dropped and the indentation common to all non-blank lines is stripped
+// from every line. If the closing delimiter is on its own line, the string ends with
+// a newline.
+func readRawString(p *Parser) {
+	for range rawStringDelim {
+		skipChar(p)
+	}
+	for !hasPrefix(p.r, rawStringDelim) {
+		if isEOF(p.r) {
+			emitSyntaxError(p, CodeUnterminatedString, "unterminated raw string")
+			return
+		}
+		nextChar(p)
+	}
+	for range rawStringDelim {
+		skipChar(p)
+	}
+
+	value := dedent(p.b.String())
+	p.b.Reset()
+	p.b.WriteString(value)
+	if !checkReferences(p) {
+		return
+	}
 	makeToken(p, StringTokenKind)
-	skipChar(p) // "
+	p.t.Raw = true
+}
+
+func dedent(s string) string {
+	if !strings.Contains(s, "\n") {
+		return s
+	}
+	s = strings.TrimPrefix(s, "\n")
+	lines := strings.Split(s, "\n")
+
+	// The final line counts towards the indentation if it only holds the closing
+	// delimiter, so that it can be used to control how much is stripped.
+	// Indentation is compared as a string, so that a tab and a space are never
+	// stripped as if they were the same.
+	last := len(lines) - 1
+	indent, found := "", false
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" && i != last {
+			continue
+		}
+		ws := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if !found {
+			indent, found = ws, true
+			continue
+		}
+		n := 0
+		for n < len(indent) && n < len(ws) && indent[n] == ws[n] {
+			n++
+		}
+		indent = indent[:n]
+	}
+
+	if strings.TrimSpace(lines[last]) == "" {
+		lines[last] = ""
+	}
+	if indent == "" {
+		return strings.Join(lines, "\n")
+	}
+	for i, line := range lines {
+		if strings.HasPrefix(line, indent) {
+			lines[i] = line[len(indent):]
+		} else {
+			// Only blank lines can lack the indentation.
+			lines[i] = strings.TrimLeft(line, " \t")
+		}
+	}
+	return strings.Join(lines, "\n")
 }
 
 func readNumber(p *Parser) {
@@ -274,17 +614,17 @@ func readNumber(p *Parser) {
 	makeToken(p, NumberTokenKind)
 }
 
-func readKeyword(p *Parser) {
+// readIdent reads a keyword or an identifier.
+func readIdent(p *Parser) {
 	nextChar(p)
-	readWhile(p, isAlpha)
+	readWhile(p, isIdent)
 
 	source := p.b.String()
 	if kind, ok := keywords[source]; ok {
 		makeToken(p, kind)
 		return
 	}
-
-	emitSyntaxError(p, "invalid keyword: %q", source)
+	makeToken(p, IdentTokenKind)
 }
 
 func readWhile(p *Parser, test interface{}) {
@@ -336,71 +676,101 @@ func peekChar(r *bufio.Reader) byte {
 	return b[0]
 }
 
+func hasPrefix(r *bufio.Reader, prefix string) bool {
+	b, _ := r.Peek(len(prefix))
+	return string(b) == prefix
+}
+
 func isEOF(r *bufio.Reader) bool {
 	_, err := r.Peek(1)
 	return errors.Is(err, io.EOF)
 }
 
 func isAlpha(b byte) bool {
-	return 'a' <= b && b < 'z' || 'A' <= b && b <= 'Z' || isDigit(b)
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || isDigit(b)
+}
+
+func isIdentStart(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || b == '_'
+}
+
+func isIdent(b byte) bool {
+	return isAlpha(b) || b == '_' || b == '-'
 }
 
 func isDigit(b byte) bool {
 	return '0' <= b && b <= '9'
 }
 
+func isHexDigit(b byte) bool {
+	return isDigit(b) || 'a' <= b && b <= 'f' || 'A' <= b && b <= 'F'
+}
+
 //
 // Errors
 //
 
-func emitError(p *Parser, e error) {
-	err := addErrorContext(p, e)
-	if p.e == nil {
-		p.e = err
+func emitError(p *Parser, kind error, code, format string, args ...interface{}) {
+	d := NewDiagnostic(p.Filename, p.s, p.t.Pos, p.t.End, kind, code, fmt.Sprintf(format, args...))
+	p.d = append(p.d, d)
+	if p.Stderr != nil {
+		fmt.Fprintln(p.Stderr, d)
 	}
-	fmt.Fprintln(p.Stderr, err)
-	fmt.Fprintln(p.Stderr, string(debug.Stack()))
 }
 
-func emitSyntaxError(p *Parser, format string, args ...interface{}) {
+func emitSyntaxError(p *Parser, code, format string, args ...interface{}) {
 	makeToken(p, ErrTokenKind)
-	emitError(p, Errorf(ErrSyntax, format, args...))
+	emitError(p, ErrSyntax, code, format, args...)
 }
 
-func emitParseError(p *Parser, format string, args ...interface{}) {
+func emitParseError(p *Parser, code, format string, args ...interface{}) {
+	recovering := p.m
+	p.m = true
+	if recovering {
+		return
+	}
 	if match(p, ErrTokenKind) { // Already reported as syntax error.
 		return
 	}
-	emitError(p, Errorf(ErrParse, format, args...))
+	emitError(p, ErrParse, code, format, args...)
 }
 
 func emitUnexpectedTokenError(p *Parser) {
 	if p.t.Kind == EofTokenKind {
-		emitParseError(p, "unexpected end of input")
+		emitParseError(p, CodeUnexpectedEOF, "unexpected end of input")
 	} else {
-		emitParseError(p, "unexpected token %v", p.t)
+		emitParseError(p, CodeUnexpectedToken, "unexpected token %v", p.t)
 	}
-	nextToken(p)
 }
 
-func addErrorContext(p *Parser, e error) error {
-	pos := p.t.Pos
-	before, after := p.s[:pos], p.s[pos:]
-	lineStart := bytes.LastIndexByte(before, '\n')
-	if lineStart < 0 {
-		lineStart = 0
+// Position returns the 1-based line and column of the given byte offset in src.
+func Position(src []byte, offset int) (line, col int) {
+	if offset > len(src) {
+		offset = len(src)
 	}
-	lineEnd := len(before) + bytes.IndexByte(after, '\n')
-	if lineEnd >= len(p.s) {
-		lineEnd = len(p.s) - 1
+	before := src[:offset]
+	line = bytes.Count(before, []byte{'\n'}) + 1
+	col = offset - (bytes.LastIndexByte(before, '\n') + 1) + 1
+	return line, col
+}
+
+// errorContext returns the line of src containing offset, followed by a line with a
+// caret pointing at the offset.
+func errorContext(src []byte, offset int) string {
+	if offset > len(src) {
+		offset = len(src)
+	}
+	lineStart := bytes.LastIndexByte(src[:offset], '\n') + 1
+	lineEnd := bytes.IndexByte(src[offset:], '\n')
+	if lineEnd < 0 {
+		lineEnd = len(src)
+	} else {
+		lineEnd += offset
 	}
 
-	line := bytes.Count(before, []byte{'\n'}) + 1
-	col := pos - lineStart
-	b := &bytes.Buffer{}
-	b.Write(p.s[lineStart:lineEnd])
+	b := &strings.Builder{}
+	b.Write(src[lineStart:lineEnd])
 	b.WriteByte('\n')
-	b.WriteString(strings.Repeat("-", col-1) + "^")
-
-	return fmt.Errorf("%w at line %d col %d:\n%s", e, line, col, b.String())
+	b.WriteString(strings.Repeat("-", offset-lineStart) + "^")
+	return b.String()
 }
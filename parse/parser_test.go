@@ -0,0 +1,135 @@
+package parse
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParse_Diagnostics(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   Diagnostics
+	}{
+		{
+			name:   "unterminated_string",
+			source: `(file "a)`,
+			want: Diagnostics{
+				{Line: 1, Column: 7, Start: 6, End: 9, Code: CodeUnterminatedString, Kind: ErrSyntax},
+			},
+		},
+		{
+			name: "recovers_at_sexpr_boundaries",
+			source: `(dir "a" (file 1 2) (file "b"))
+(file "c" (@perms ~))
+(dir "d")
+"stray"
+(file "e" (@contents "\q"))`,
+			want: Diagnostics{
+				{Line: 2, Column: 19, Start: 50, End: 51, Code: CodeInvalidCharacter, Kind: ErrSyntax},
+				{Line: 4, Column: 1, Start: 64, End: 71, Code: CodeUnexpectedToken, Kind: ErrParse},
+				{Line: 5, Column: 22, Start: 93, End: 97, Code: CodeInvalidEscape, Kind: ErrSyntax},
+			},
+		},
+		{
+			name:   "missing_head",
+			source: "(\n  (file \"a\"))\n(dir",
+			want: Diagnostics{
+				{Line: 2, Column: 3, Start: 4, End: 5, Code: CodeUnexpectedToken, Kind: ErrParse},
+				{Line: 3, Column: 5, Start: 20, End: 20, Code: CodeUnexpectedEOF, Kind: ErrParse},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &Parser{Filename: "test.tree"}
+			_, err := p.Parse(strings.NewReader(test.source))
+			var got Diagnostics
+			if !errors.As(err, &got) {
+				t.Fatalf("Parse(`%s`) wanted Diagnostics but got %v", test.source, err)
+			}
+			for i := range test.want {
+				test.want[i].Filename = "test.tree"
+			}
+			for i := range got {
+				got[i].Message = ""
+				got[i].context = ""
+			}
+			opts := cmp.Comparer(func(a, b Diagnostic) bool { return a == b })
+			if diff := cmp.Diff(test.want, got, opts); diff != "" {
+				t.Fatalf("Parse(`%s`) got diff (+got,-want):\n%s\n", test.source, diff)
+			}
+		})
+	}
+}
+
+func TestParse_RawStrings(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			name:   "single_line",
+			source: `"""raw "quoted" \t"""`,
+			want:   `raw "quoted" \t`,
+		},
+		{
+			name:   "common_indent_stripped",
+			source: "\"\"\"\n    foo\n      bar\n    \"\"\"",
+			want:   "foo\n  bar\n",
+		},
+		{
+			name:   "first_line_not_indented",
+			source: "\"\"\"\nfoo\n  bar\n\"\"\"",
+			want:   "foo\n  bar\n",
+		},
+		{
+			name:   "blank_lines",
+			source: "\"\"\"\n    foo\n\n  \n      bar\n    \"\"\"",
+			want:   "foo\n\n\n  bar\n",
+		},
+		{
+			name:   "mixed_tabs_and_spaces",
+			source: "\"\"\"\n\t  foo\n  \tbar\n\t  \"\"\"",
+			want:   "\t  foo\n  \tbar\n",
+		},
+		{
+			name:   "common_tab_indent_stripped",
+			source: "\"\"\"\n\t\tfoo\n\t bar\n\t\"\"\"",
+			want:   "\tfoo\n bar\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &Parser{Filename: "test.tree"}
+			tree, err := p.Parse(strings.NewReader(`(file "a" (@contents ` + test.source + `))`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := tree.SExprs[0].Args[1].SExpr.Args[0].Literal.Token.Value
+			if got != test.want {
+				t.Errorf("Parse(`%s`) got %q, want %q", test.source, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParse_Identifiers(t *testing.T) {
+	for _, ident := range []string{"zone", "fizz", "a_z", "Zz-9"} {
+		t.Run(ident, func(t *testing.T) {
+			p := &Parser{Filename: "test.tree"}
+			tree, err := p.Parse(strings.NewReader(`(when (eq ` + ident + ` "a") (file "a"))`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tok := tree.SExprs[0].Args[0].SExpr.Args[0].Token
+			if tok.Kind != IdentTokenKind || tok.Value != ident {
+				t.Errorf("Parse(%q) got %s %q, want an identifier", ident, tok.Kind, tok.Value)
+			}
+		})
+	}
+}
@@ -0,0 +1,514 @@
+package mktree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kendalharland/mktree/internal/diff"
+)
+
+// Action is the effect applying a Plan has on a single path.
+type Action int
+
+const (
+	// ActionCreate means the path does not exist and will be created.
+	ActionCreate Action = iota
+	// ActionModify means the path exists but its contents, mode or link target
+	// will be updated.
+	ActionModify
+	// ActionUnchanged means the path already matches the tree.
+	ActionUnchanged
+	// ActionConflict means the path exists but cannot be updated to match the
+	// tree, for example because it is a file where the tree declares a directory.
+	ActionConflict
+	// ActionSkip means the path exists and does not match the tree, but is left
+	// unchanged because of its ExistsPolicy.
+	ActionSkip
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionCreate:
+		return "create"
+	case ActionModify:
+		return "modify"
+	case ActionUnchanged:
+		return "unchanged"
+	case ActionConflict:
+		return "conflict"
+	case ActionSkip:
+		return "skip"
+	}
+	return fmt.Sprintf("Action(%d)", int(a))
+}
+
+func (a Action) symbol() string {
+	switch a {
+	case ActionCreate:
+		return "+"
+	case ActionModify:
+		return "~"
+	case ActionConflict:
+		return "!"
+	case ActionSkip:
+		return "-"
+	}
+	return "="
+}
+
+// ExistsPolicy determines what happens to an existing entry that does not match
+// the tree.
+type ExistsPolicy string
+
+const (
+	// ExistsDefault updates existing entries in place, and reports a conflict if an
+	// entry is of a different kind than the tree declares.
+	ExistsDefault ExistsPolicy = ""
+	// ExistsSkip leaves existing entries unchanged.
+	ExistsSkip ExistsPolicy = "skip"
+	// ExistsOverwrite updates existing entries in place and replaces entries of a
+	// different kind than the tree declares.
+	ExistsOverwrite ExistsPolicy = "overwrite"
+	// ExistsError reports a conflict for every existing entry that does not match
+	// the tree.
+	ExistsError ExistsPolicy = "error"
+	// ExistsBackup moves existing entries to an unused path with a ".bak" suffix
+	// before replacing them. Directories whose mode differs are updated in place.
+	ExistsBackup ExistsPolicy = "backup"
+)
+
+// ParseExistsPolicy returns the policy with the given name.
+func ParseExistsPolicy(name string) (ExistsPolicy, error) {
+	switch p := ExistsPolicy(name); p {
+	case ExistsSkip, ExistsOverwrite, ExistsError, ExistsBackup:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid policy %q: must be one of skip, overwrite, error or backup", name)
+}
+
+// Change describes the effect of a Plan on a single dir, file or link.
+type Change struct {
+	Path   string
+	Kind   string // One of "dir", "file" or "link".
+	Action Action
+
+	// Reason explains a modification or conflict.
+	Reason string
+
+	// Diff is the unified diff between the existing and planned file contents, if
+	// the contents of a file are modified.
+	Diff string
+
+	// Backup is the path the existing entry is moved to before it is replaced, if
+	// any.
+	Backup string
+
+	dir      *dir
+	file     *file
+	link     *link
+	problems []Problem // How the existing entry differs from the tree.
+	contents []byte    // The planned file contents.
+	conflict bool      // Whether the existing entry is of a different kind.
+	missing  bool      // Whether the entry is skipped because its parent is.
+	replace  bool      // Whether the existing entry is removed before it is replaced.
+}
+
+// Plan is the set of changes needed to make the filesystem match a Tree.
+type Plan struct {
+	Changes []*Change
+
+	// Transactional makes Apply undo every change it made if any change fails.
+	Transactional bool
+
+	fs FS
+}
+
+// PlanFile interprets the given file and compares the result against the
+// filesystem. The arguments are the same as for ExecFile.
+func (i *Interpreter) PlanFile(r io.Reader, filename string, opts ...Option) (*Plan, error) {
+	if i.Exists != ExistsDefault {
+		if _, err := ParseExistsPolicy(string(i.Exists)); err != nil {
+			return nil, err
+		}
+	}
+	tree, err := i.InterpretFile(r, filename, opts...)
+	if err != nil {
+		return nil, err
+	}
+	p, err := planTree(tree.thr, tree, i.Exists)
+	if err != nil {
+		return nil, err
+	}
+	p.Transactional = i.Transactional
+	return p, nil
+}
+
+// Conflicts returns the changes that conflict with the existing filesystem.
+func (p *Plan) Conflicts() []*Change {
+	var conflicts []*Change
+	for _, c := range p.Changes {
+		if c.Action == ActionConflict {
+			conflicts = append(conflicts, c)
+		}
+	}
+	return conflicts
+}
+
+// Count returns the number of changes with the given action.
+func (p *Plan) Count(a Action) int {
+	n := 0
+	for _, c := range p.Changes {
+		if c.Action == a {
+			n++
+		}
+	}
+	return n
+}
+
+// Print writes a human-readable description of the plan to w.
+func (p *Plan) Print(w io.Writer) {
+	for _, c := range p.Changes {
+		fmt.Fprintf(w, "%s %-4s %s", c.Action.symbol(), c.Kind, c.Path)
+		if c.Reason != "" {
+			fmt.Fprintf(w, " (%s)", c.Reason)
+		}
+		fmt.Fprintln(w)
+		if c.Diff != "" {
+			fmt.Fprint(w, indentLines(c.Diff, "    "))
+		}
+	}
+	fmt.Fprintf(w, "Plan: %d to create, %d to modify, %d unchanged, %d skipped, %d conflicts\n",
+		p.Count(ActionCreate), p.Count(ActionModify), p.Count(ActionUnchanged), p.Count(ActionSkip), p.Count(ActionConflict))
+}
+
+// Apply makes the changes in the plan. It returns an error without changing
+// anything if the plan has conflicts. If a change fails and the plan is
+// transactional, the changes already made are rolled back before returning.
+func (p *Plan) Apply() error {
+	if conflicts := p.Conflicts(); len(conflicts) > 0 {
+		var ss []string
+		for _, c := range conflicts {
+			ss = append(ss, fmt.Sprintf("%s: %s", c.Path, c.Reason))
+		}
+		return fmt.Errorf("plan has %d conflicts:\n%s", len(conflicts), strings.Join(ss, "\n"))
+	}
+
+	j := &journal{fs: p.fs}
+	for _, c := range p.Changes {
+		if err := applyChange(j, c); err != nil {
+			if !p.Transactional {
+				j.commit()
+				return err
+			}
+			if rerr := j.rollback(); rerr != nil {
+				return fmt.Errorf("%w (%v)", err, rerr)
+			}
+			return err
+		}
+	}
+	return j.commit()
+}
+
+func indentLines(s, indent string) string {
+	lines := strings.SplitAfter(s, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = indent + line
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+//
+// Planning
+//
+
+// parentState describes the directory containing an entry in a plan.
+type parentState int
+
+const (
+	// The parent directory exists and may contain existing entries.
+	parentExists parentState = iota
+	// The parent directory will be created, so it has no existing entries.
+	parentNew
+	// The parent path is not a directory and is left unchanged.
+	parentSkipped
+)
+
+func planTree(thr *thread, t *Tree, policy ExistsPolicy) (*Plan, error) {
+	p := &Plan{fs: thr.fs}
+	if err := planDir(thr, p, t.root, policy, parentExists, true); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func planDir(thr *thread, p *Plan, d *dir, policy ExistsPolicy, parent parentState, isRoot bool) error {
+	if d.exists != "" {
+		policy = d.exists
+	}
+	c := &Change{Path: d.name, Kind: "dir", dir: d}
+	p.Changes = append(p.Changes, c)
+
+	planChange(p.fs, c, policy, parent, func(stat os.FileInfo) {
+		switch {
+		case !stat.IsDir():
+			c.differ(ActionConflict, ProblemKind, "exists and is not a directory")
+		case !isRoot && d.hasPerms && stat.Mode() != d.perms:
+			c.differ(ActionModify, ProblemMode, fmt.Sprintf("mode %v -> %v", stat.Mode(), d.perms))
+		default:
+			c.Action = ActionUnchanged
+		}
+	})
+
+	switch {
+	case c.Action == ActionCreate || c.Backup != "" || c.replace:
+		parent = parentNew
+	case c.Action == ActionSkip && c.conflict:
+		parent = parentSkipped
+	default:
+		parent = parentExists
+	}
+
+	for _, child := range d.dirs {
+		if err := planDir(thr, p, child, policy, parent, false); err != nil {
+			return err
+		}
+	}
+	for _, child := range d.files {
+		if err := planFile(thr, p, d, child, policy, parent); err != nil {
+			return err
+		}
+	}
+	for _, child := range d.links {
+		planLink(p, child, policy, parent)
+	}
+	return nil
+}
+
+func planFile(thr *thread, p *Plan, d *dir, f *file, policy ExistsPolicy, parent parentState) error {
+	if f.exists != "" {
+		policy = f.exists
+	}
+	contents, err := fileContents(thr, d, f)
+	if err != nil {
+		return err
+	}
+	c := &Change{Path: f.name, Kind: "file", file: f, contents: []byte(contents)}
+	p.Changes = append(p.Changes, c)
+
+	planChange(p.fs, c, policy, parent, func(stat os.FileInfo) {
+		if !stat.Mode().IsRegular() {
+			c.differ(ActionConflict, ProblemKind, "exists and is not a regular file")
+			return
+		}
+		existing, err := p.fs.ReadFile(f.name)
+		if err != nil {
+			c.differ(ActionConflict, ProblemUnreadable, err.Error())
+			return
+		}
+
+		c.Action = ActionUnchanged
+		if f.hasPerms && stat.Mode() != f.perms {
+			c.differ(ActionModify, ProblemMode, fmt.Sprintf("mode %v -> %v", stat.Mode(), f.perms))
+		}
+		if !bytes.Equal(existing, c.contents) {
+			c.Diff = contentsDiff(f.name, existing, c.contents)
+			c.differ(ActionModify, ProblemContents, "contents differ")
+		}
+	})
+	return nil
+}
+
+func planLink(p *Plan, l *link, policy ExistsPolicy, parent parentState) {
+	if l.exists != "" {
+		policy = l.exists
+	}
+	c := &Change{Path: l.name, Kind: "link", link: l}
+	p.Changes = append(p.Changes, c)
+
+	planChange(p.fs, c, policy, parent, func(stat os.FileInfo) {
+		if !l.symbolic {
+			target, err := p.fs.Stat(l.target)
+			if err == nil && p.fs.SameFile(stat, target) {
+				c.Action = ActionUnchanged
+				return
+			}
+			c.differ(ActionConflict, ProblemKind, "exists and is not a hard link to "+l.target)
+			return
+		}
+
+		if stat.Mode()&os.ModeSymlink == 0 {
+			c.differ(ActionConflict, ProblemKind, "exists and is not a symbolic link")
+			return
+		}
+		target, err := p.fs.Readlink(l.name)
+		switch {
+		case err != nil:
+			c.differ(ActionConflict, ProblemUnreadable, err.Error())
+		case target != l.target:
+			c.differ(ActionModify, ProblemTarget, fmt.Sprintf("target %s -> %s", target, l.target))
+		default:
+			c.Action = ActionUnchanged
+		}
+	})
+}
+
+// planChange sets the action of c. If c.Path exists, compare is called to set the
+// action by comparing the existing entry with the tree, and then the policy is
+// applied to the result.
+func planChange(fsys FS, c *Change, policy ExistsPolicy, parent parentState, compare func(os.FileInfo)) {
+	switch parent {
+	case parentNew:
+		c.Action = ActionCreate
+		return
+	case parentSkipped:
+		c.Action, c.Reason, c.missing = ActionSkip, "parent is skipped", true
+		return
+	}
+
+	stat, err := fsys.Lstat(c.Path)
+	switch {
+	case os.IsNotExist(err):
+		c.Action = ActionCreate
+		return
+	case err != nil:
+		c.differ(ActionConflict, ProblemUnreadable, err.Error())
+		return
+	}
+
+	compare(stat)
+	c.conflict = c.Action == ActionConflict
+
+	switch {
+	case c.Action == ActionUnchanged:
+	case policy == ExistsSkip:
+		c.Action, c.Reason, c.Diff = ActionSkip, "skipped, "+c.Reason, ""
+	case policy == ExistsError:
+		c.Action = ActionConflict
+	case policy == ExistsOverwrite && c.conflict:
+		c.Action, c.replace = ActionModify, true
+		c.Reason += ", replacing it"
+	case policy == ExistsBackup && (c.conflict || c.Kind != "dir"):
+		// Directories whose mode differs are updated in place.
+		c.Action, c.Backup = ActionModify, backupPath(fsys, c.Path)
+		c.Reason += ", moving it to " + c.Backup
+	}
+}
+
+// differ records that the existing entry differs from the tree in the way
+// described by problem and reason, and sets the action needed to update it.
+func (c *Change) differ(action Action, problem, reason string) {
+	c.problems = append(c.problems, Problem{Path: c.Path, Kind: c.Kind, Problem: problem, Message: reason})
+	if c.Reason != "" {
+		c.Reason += ", "
+	}
+	c.Action, c.Reason = action, c.Reason+reason
+}
+
+// backupPath returns an unused path to move the existing entry at name to.
+func backupPath(fsys FS, name string) string {
+	backup := name + ".bak"
+	for n := 1; ; n++ {
+		if _, err := fsys.Lstat(backup); os.IsNotExist(err) {
+			return backup
+		}
+		backup = fmt.Sprintf("%s.bak.%d", name, n)
+	}
+}
+
+// contentsDiff returns a unified diff between the old and new contents of the
+// named file, or a short description if either is binary.
+func contentsDiff(name string, old, new []byte) string {
+	if bytes.IndexByte(old, 0) >= 0 || bytes.IndexByte(new, 0) >= 0 {
+		return fmt.Sprintf("Binary files %s differ\n", name)
+	}
+	return diff.Unified(name, name, string(old), string(new))
+}
+
+//
+// Generators
+//
+
+func applyChange(j *journal, c *Change) error {
+	if c.Action != ActionCreate && c.Action != ActionModify {
+		return nil
+	}
+	switch {
+	case c.Backup != "":
+		if err := j.rename(c.Path, c.Backup); err != nil {
+			return err
+		}
+	case c.replace:
+		if err := j.remove(c.Path); err != nil {
+			return err
+		}
+	}
+	switch {
+	case c.dir != nil:
+		return applyDir(j, c)
+	case c.file != nil:
+		return applyFile(j, c)
+	case c.link != nil:
+		return applyLink(j, c)
+	}
+	return errors.New("invalid change")
+}
+
+// inPlace reports whether c modifies an existing entry rather than creating one.
+func (c *Change) inPlace() bool {
+	return c.Action == ActionModify && c.Backup == "" && !c.replace
+}
+
+func applyDir(j *journal, c *Change) error {
+	d := c.dir
+	if c.inPlace() {
+		return j.chmod(d.name, d.perms)
+	}
+	return j.mkdirAll(d.name, d.perms)
+}
+
+func applyFile(j *journal, c *Change) error {
+	f := c.file
+	if err := j.mkdirAll(filepath.Dir(f.name), defaultDirMode); err != nil {
+		return err
+	}
+	perms := f.perms
+	if c.inPlace() && !f.hasPerms {
+		// Keep the mode of an existing file unless it is set with @perms.
+		stat, err := j.fs.Lstat(f.name)
+		if err != nil {
+			return err
+		}
+		perms = stat.Mode()
+	}
+	return j.writeFile(f.name, c.contents, perms)
+}
+
+func applyLink(j *journal, c *Change) error {
+	l := c.link
+	if err := j.mkdirAll(filepath.Dir(l.name), defaultDirMode); err != nil {
+		return err
+	}
+	if c.inPlace() {
+		if err := j.remove(l.name); err != nil {
+			return err
+		}
+	}
+
+	linker := j.fs.Link
+	if l.symbolic {
+		linker = j.fs.Symlink
+	}
+
+	if err := linker(l.target, l.name); err != nil {
+		return err
+	}
+	j.created(l.name)
+	return nil
+}
@@ -0,0 +1,438 @@
+package mktree
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestInterpreter_PlanFile(t *testing.T) {
+	type change struct {
+		Path   string
+		Action Action
+		Reason string
+	}
+
+	tests := []struct {
+		name   string
+		setup  func(root string) error
+		source string
+		policy ExistsPolicy
+		want   []change
+	}{
+		{
+			name:   "create",
+			source: `(dir "a" (file "b") (link "b" "c" (@symbolic)))`,
+			want: []change{
+				{Path: ".", Action: ActionUnchanged},
+				{Path: "a", Action: ActionCreate},
+				{Path: "a/b", Action: ActionCreate},
+				{Path: "a/c", Action: ActionCreate},
+			},
+		},
+		{
+			name: "unchanged",
+			setup: func(root string) error {
+				return writeFiles(root, map[string]string{"a": "hello"})
+			},
+			source: `(file "a" (@contents "hello"))`,
+			want: []change{
+				{Path: ".", Action: ActionUnchanged},
+				{Path: "a", Action: ActionUnchanged},
+			},
+		},
+		{
+			name: "modify_contents",
+			setup: func(root string) error {
+				return writeFiles(root, map[string]string{"a": "hello"})
+			},
+			source: `(file "a" (@contents "goodbye"))`,
+			want: []change{
+				{Path: ".", Action: ActionUnchanged},
+				{Path: "a", Action: ActionModify, Reason: "contents differ"},
+			},
+		},
+		{
+			name: "modify_perms",
+			setup: func(root string) error {
+				if err := os.Mkdir(filepath.Join(root, "d"), 0); err != nil {
+					return err
+				}
+				if err := os.Chmod(filepath.Join(root, "d"), 0777); err != nil {
+					return err
+				}
+				return writeFiles(root, map[string]string{"a": ""})
+			},
+			source: `(file "a" (@perms 0600)) (dir "d" (@perms 0700))`,
+			want: []change{
+				{Path: ".", Action: ActionUnchanged},
+				{Path: "d", Action: ActionModify, Reason: "mode drwxrwxrwx -> drwx------"},
+				{Path: "a", Action: ActionModify, Reason: "mode -rw-rw-rw- -> -rw-------"},
+			},
+		},
+		{
+			name: "existing_modes_kept_without_perms",
+			setup: func(root string) error {
+				if err := os.Mkdir(filepath.Join(root, "d"), 0700); err != nil {
+					return err
+				}
+				if err := writeFiles(root, map[string]string{"a": ""}); err != nil {
+					return err
+				}
+				return os.Chmod(filepath.Join(root, "a"), 0600)
+			},
+			source: `(file "a") (dir "d")`,
+			want: []change{
+				{Path: ".", Action: ActionUnchanged},
+				{Path: "d", Action: ActionUnchanged},
+				{Path: "a", Action: ActionUnchanged},
+			},
+		},
+		{
+			name: "modify_symlink",
+			setup: func(root string) error {
+				return os.Symlink("x", filepath.Join(root, "b"))
+			},
+			source: `(link "/a" "b" (@symbolic))`,
+			want: []change{
+				{Path: ".", Action: ActionUnchanged},
+				{Path: "b", Action: ActionModify, Reason: "target x -> /a"},
+			},
+		},
+		{
+			name: "conflict",
+			setup: func(root string) error {
+				return writeFiles(root, map[string]string{"a": "", "b": "", "c": ""})
+			},
+			source: `(dir "a") (link "c" "b")`,
+			want: []change{
+				{Path: ".", Action: ActionUnchanged},
+				{Path: "a", Action: ActionConflict, Reason: "exists and is not a directory"},
+				{Path: "b", Action: ActionConflict, Reason: "exists and is not a hard link to c"},
+			},
+		},
+		{
+			name: "policy_skip",
+			setup: func(root string) error {
+				return writeFiles(root, map[string]string{"a": "hello", "d": ""})
+			},
+			source: `(file "a" (@contents "goodbye")) (dir "d" (file "e"))`,
+			policy: ExistsSkip,
+			want: []change{
+				{Path: ".", Action: ActionUnchanged},
+				{Path: "d", Action: ActionSkip, Reason: "skipped, exists and is not a directory"},
+				{Path: "d/e", Action: ActionSkip, Reason: "parent is skipped"},
+				{Path: "a", Action: ActionSkip, Reason: "skipped, contents differ"},
+			},
+		},
+		{
+			name: "policy_error",
+			setup: func(root string) error {
+				return writeFiles(root, map[string]string{"a": "hello", "b": "hello"})
+			},
+			source: `(file "a" (@contents "goodbye")) (file "b" (@contents "hello"))`,
+			policy: ExistsError,
+			want: []change{
+				{Path: ".", Action: ActionUnchanged},
+				{Path: "a", Action: ActionConflict, Reason: "contents differ"},
+				{Path: "b", Action: ActionUnchanged},
+			},
+		},
+		{
+			name: "policy_overwrite",
+			setup: func(root string) error {
+				return writeFiles(root, map[string]string{"a": "hello", "d": ""})
+			},
+			source: `(file "a" (@contents "goodbye")) (dir "d" (file "e"))`,
+			policy: ExistsOverwrite,
+			want: []change{
+				{Path: ".", Action: ActionUnchanged},
+				{Path: "d", Action: ActionModify, Reason: "exists and is not a directory, replacing it"},
+				{Path: "d/e", Action: ActionCreate},
+				{Path: "a", Action: ActionModify, Reason: "contents differ"},
+			},
+		},
+		{
+			name: "policy_backup",
+			setup: func(root string) error {
+				return writeFiles(root, map[string]string{"a": "hello", "a.bak": ""})
+			},
+			source: `(file "a" (@contents "goodbye"))`,
+			policy: ExistsBackup,
+			want: []change{
+				{Path: ".", Action: ActionUnchanged},
+				{Path: "a", Action: ActionModify, Reason: "contents differ, moving it to a.bak.1"},
+			},
+		},
+		{
+			name: "policy_attribute",
+			setup: func(root string) error {
+				if err := os.Mkdir(filepath.Join(root, "d"), 0); err != nil {
+					return err
+				}
+				if err := os.Chmod(filepath.Join(root, "d"), 0777); err != nil {
+					return err
+				}
+				return writeFiles(root, map[string]string{"d/a": "", "d/b": ""})
+			},
+			source: `
+			(dir "d" (@exists "skip")
+				(file "a" (@contents "x"))
+				(file "b" (@contents "x") (@exists "overwrite")))
+			`,
+			policy: ExistsError,
+			want: []change{
+				{Path: ".", Action: ActionUnchanged},
+				{Path: "d", Action: ActionUnchanged},
+				{Path: "d/a", Action: ActionSkip, Reason: "skipped, contents differ"},
+				{Path: "d/b", Action: ActionModify, Reason: "contents differ"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := tempDir(t)
+			if tt.setup != nil {
+				if err := tt.setup(root); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			i := &Interpreter{Root: root, Exists: tt.policy}
+			p, err := i.PlanFile(strings.NewReader(tt.source), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []change
+			for _, c := range p.Changes {
+				path, err := filepath.Rel(root, c.Path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				reason := strings.ReplaceAll(c.Reason, root+string(filepath.Separator), "")
+				got = append(got, change{Path: filepath.ToSlash(path), Action: c.Action, Reason: reason})
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("got unexpected changes (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPlan_Apply(t *testing.T) {
+	root := tempDir(t)
+	if err := writeFiles(root, map[string]string{"a": "one\ntwo\n"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("x", filepath.Join(root, "c")); err != nil {
+		t.Fatal(err)
+	}
+
+	source := `
+(file "a" (@contents "one\nthree\n") (@perms 0600))
+(file "b")
+(link "b" "c" (@symbolic))
+`
+	i := &Interpreter{Root: root}
+	p, err := i.PlanFile(strings.NewReader(source), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantDiff := strings.Join([]string{
+		"--- " + filepath.Join(root, "a"),
+		"+++ " + filepath.Join(root, "a"),
+		"@@ -1,2 +1,2 @@",
+		" one",
+		"-two",
+		"+three",
+		"",
+	}, "\n")
+	if diff := cmp.Diff(wantDiff, p.Changes[1].Diff); diff != "" {
+		t.Errorf("got unexpected diff (-want,+got):\n%s", diff)
+	}
+
+	if err := p.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, OSFS{}, filepath.Join(root, "a"), os.FileMode(0600), "one\nthree\n")
+	assertFile(t, OSFS{}, filepath.Join(root, "b"), defaultFileMode, "")
+	assertLink(t, OSFS{}, filepath.Join(root, "b"), filepath.Join(root, "c"))
+
+	// Applying the same source again changes nothing.
+	p, err = i.PlanFile(strings.NewReader(source), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := p.Count(ActionUnchanged); n != len(p.Changes) {
+		t.Errorf("got %d unchanged entries after apply, want %d", n, len(p.Changes))
+	}
+}
+
+func TestPlan_ApplyKeepsModes(t *testing.T) {
+	root := tempDir(t)
+	if err := writeFiles(root, map[string]string{"a": "old"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(root, "a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	i := &Interpreter{Root: root}
+	if err := i.ExecFile(strings.NewReader(`(file "a" (@contents "new"))`), ""); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, OSFS{}, filepath.Join(root, "a"), os.FileMode(0600), "new")
+}
+
+func TestPlan_ApplyConflicts(t *testing.T) {
+	root := tempDir(t)
+	if err := writeFiles(root, map[string]string{"a": ""}); err != nil {
+		t.Fatal(err)
+	}
+
+	i := &Interpreter{Root: root}
+	p, err := i.PlanFile(strings.NewReader(`(file "b") (dir "a")`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Apply(); err == nil {
+		t.Fatal("expected an error but got nil")
+	}
+	if _, err := os.Lstat(filepath.Join(root, "b")); !os.IsNotExist(err) {
+		t.Errorf("expected a plan with conflicts to change nothing, but %q exists", "b")
+	}
+}
+
+func TestPlan_ApplyPolicies(t *testing.T) {
+	root := tempDir(t)
+	if err := writeFiles(root, map[string]string{"a": "old", "b": "", "c": ""}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "d"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	source := `
+(file "a" (@contents "new") (@exists "backup"))
+(dir "b" (@exists "overwrite") (file "e"))
+(link "a" "c" (@exists "backup"))
+(file "d" (@exists "overwrite"))
+`
+	i := &Interpreter{Root: root}
+	if err := i.ExecFile(strings.NewReader(source), ""); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, OSFS{}, filepath.Join(root, "a"), defaultFileMode, "new")
+	assertFile(t, OSFS{}, filepath.Join(root, "a.bak"), defaultFileMode, "old")
+	assertDir(t, OSFS{}, filepath.Join(root, "b"), defaultDirMode)
+	assertFile(t, OSFS{}, filepath.Join(root, "b/e"), defaultFileMode, "")
+	if a, c := lstat(t, filepath.Join(root, "a")), lstat(t, filepath.Join(root, "c")); !os.SameFile(a, c) {
+		t.Errorf("expected %q to be a hard link to %q", "c", "a")
+	}
+	assertFile(t, OSFS{}, filepath.Join(root, "c.bak"), defaultFileMode, "")
+	assertFile(t, OSFS{}, filepath.Join(root, "d"), defaultFileMode, "")
+}
+
+func lstat(t *testing.T, name string) os.FileInfo {
+	t.Helper()
+	stat, err := os.Lstat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stat
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	root, err := ioutil.TempDir("", "mktree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	return root
+}
+
+// writeFiles creates files in root with the default file mode, regardless of the umask.
+func writeFiles(root string, files map[string]string) error {
+	for name, contents := range files {
+		name = filepath.Join(root, name)
+		if err := ioutil.WriteFile(name, []byte(contents), defaultFileMode); err != nil {
+			return err
+		}
+		if err := os.Chmod(name, defaultFileMode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestPlan_ApplyTransactional(t *testing.T) {
+	// The link to a missing target fails after everything else is applied.
+	source := `
+(dir "a" (file "b"))
+(file "c" (@contents "new"))
+(file "d" (@contents "new") (@exists "backup"))
+(file "e" (@exists "overwrite"))
+(dir "f" (@perms 0700))
+(link "missing" "g")
+`
+	setup := func(t *testing.T) string {
+		root := tempDir(t)
+		if err := writeFiles(root, map[string]string{"c": "old", "d": "old"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(root, "e/x"), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Mkdir(filepath.Join(root, "f"), 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(filepath.Join(root, "f"), 0777); err != nil {
+			t.Fatal(err)
+		}
+		return root
+	}
+
+	t.Run("rollback", func(t *testing.T) {
+		root := setup(t)
+		i := &Interpreter{Root: root, Transactional: true}
+		if err := i.ExecFile(strings.NewReader(source), ""); err == nil {
+			t.Fatal("expected an error but got nil")
+		}
+
+		entries, err := ioutil.ReadDir(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		if diff := cmp.Diff([]string{"c", "d", "e", "f"}, names); diff != "" {
+			t.Errorf("got unexpected entries after rollback (-want,+got):\n%s", diff)
+		}
+		assertFile(t, OSFS{}, filepath.Join(root, "c"), defaultFileMode, "old")
+		assertFile(t, OSFS{}, filepath.Join(root, "d"), defaultFileMode, "old")
+		lstat(t, filepath.Join(root, "e/x"))
+		assertDir(t, OSFS{}, filepath.Join(root, "f"), defaultDirMode)
+	})
+
+	t.Run("no_rollback", func(t *testing.T) {
+		root := setup(t)
+		i := &Interpreter{Root: root}
+		if err := i.ExecFile(strings.NewReader(source), ""); err == nil {
+			t.Fatal("expected an error but got nil")
+		}
+		assertFile(t, OSFS{}, filepath.Join(root, "a/b"), defaultFileMode, "")
+		assertFile(t, OSFS{}, filepath.Join(root, "c"), defaultFileMode, "new")
+		assertFile(t, OSFS{}, filepath.Join(root, "d.bak"), defaultFileMode, "old")
+		assertFile(t, OSFS{}, filepath.Join(root, "e"), defaultFileMode, "")
+	})
+}
@@ -0,0 +1,101 @@
+package mktree
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// checkAnswer returns an error if value is not a valid answer when prompting for
+// v. An empty answer is only valid if it is the default.
+func checkAnswer(v *Var, value string) error {
+	if value == "" && !(v.HasDefault && v.Default == "") {
+		return errors.New("a value is required")
+	}
+	return v.Validate(value)
+}
+
+// LinePrompt returns a function for Interpreter.Prompt that asks for each
+// variable on w and reads the answer from a line of r. The variable's
+// description and default are shown if it has them, and an empty answer selects
+// the default. Invalid answers are reported and the variable is asked for again.
+func LinePrompt(r io.Reader, w io.Writer) func(*Var) (string, error) {
+	br := bufio.NewReader(r)
+	return func(v *Var) (string, error) {
+		if v.Doc != "" {
+			fmt.Fprintln(w, v.Doc)
+		}
+		for {
+			fmt.Fprint(w, v.Name)
+			if v.HasDefault {
+				fmt.Fprintf(w, " [%s]", v.Default)
+			}
+			fmt.Fprint(w, ": ")
+
+			line, err := br.ReadString('\n')
+			if err != nil && (err != io.EOF || line == "") {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return "", fmt.Errorf("reading a value for %s: %w", v.Name, err)
+			}
+			value := strings.TrimRight(line, "\r\n")
+			if value == "" && v.HasDefault {
+				value = v.Default
+			}
+			if err := checkAnswer(v, value); err != nil {
+				fmt.Fprintf(w, "invalid value: %v\n", err)
+				continue
+			}
+			return value, nil
+		}
+	}
+}
+
+// promptVars sets the value of each declared variable that is not given, using
+// i.Prompt. The answer for a list variable is split into a list. Variables that
+// are not declared are asked for when they are substituted; see
+// thread.promptVar.
+func (i *Interpreter) promptVars(decls []*Var, given map[string]bool, values map[string]string, lists map[string][]string) error {
+	for _, v := range decls {
+		if given[v.Name] {
+			continue
+		}
+		value, err := i.Prompt(v)
+		if err != nil {
+			return err
+		}
+		if err := checkAnswer(v, value); err != nil {
+			return fmt.Errorf("invalid value for %s: %w", v.Name, err)
+		}
+		if v.Type == VarList {
+			lists[v.Name] = splitList(value)
+		} else {
+			values[v.Name] = value
+		}
+	}
+	return nil
+}
+
+// promptVar returns the value of a variable that is substituted but is not
+// declared or given, asking for it the first time.
+func (thr *thread) promptVar(name string) (string, error) {
+	if value, ok := thr.answers[name]; ok {
+		return value, nil
+	}
+	v := &Var{Name: name}
+	value, err := thr.prompt(v)
+	if err != nil {
+		return "", err
+	}
+	if err := checkAnswer(v, value); err != nil {
+		return "", fmt.Errorf("invalid value for %s: %w", v.Name, err)
+	}
+	if thr.answers == nil {
+		thr.answers = map[string]string{}
+	}
+	thr.answers[name] = value
+	return value, nil
+}
@@ -0,0 +1,97 @@
+package mktree
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestInterpreter_Prompt(t *testing.T) {
+	source := `
+(var "a" (@default "one") (@doc "The first file."))
+(var "b")
+(file "%(a)")
+(file "%(b)")
+(file "%(c)")
+(define pkg (name) (dir name (file "%(name).go")) (file d))
+(use pkg "p")
+(when (eq a "x") (file "%(e)"))
+`
+	var asked []string
+	i := &Interpreter{
+		Root: "[test_root]",
+		Vars: map[string]string{"b": "two"},
+		Prompt: func(v *Var) (string, error) {
+			asked = append(asked, v.Name)
+			return v.Name + "_answer", nil
+		},
+	}
+	tree, err := i.InterpretFile(strings.NewReader(source), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"a", "c", "d"}, asked); diff != "" {
+		t.Errorf("got unexpected prompts (-want,+got):\n%s", diff)
+	}
+	want, err := mkdir("[test_root]", []interface{}{
+		&file{name: "[test_root]/a_answer", perms: defaultFileMode},
+		&file{name: "[test_root]/two", perms: defaultFileMode},
+		&file{name: "[test_root]/c_answer", perms: defaultFileMode},
+		&dir{name: "[test_root]/p", perms: defaultDirMode, files: []*file{
+			{name: "[test_root]/p/p.go", perms: defaultFileMode},
+		}},
+		&file{name: "[test_root]/d_answer", perms: defaultFileMode},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, tree.root, treeCmpOpts...); diff != "" {
+		t.Errorf("got unexpected tree (-want,+got):\n%s", diff)
+	}
+
+	// Nothing is asked for if undefined variables are allowed.
+	asked = nil
+	i.AllowUndefinedVars = true
+	if _, err := i.InterpretFile(strings.NewReader(source), ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(asked) != 0 {
+		t.Errorf("got prompts %v with undefined variables allowed, want none", asked)
+	}
+
+	// Invalid answers are rejected.
+	i = &Interpreter{Prompt: func(*Var) (string, error) { return "", nil }}
+	if _, err := i.InterpretFile(strings.NewReader(`(file "%(a)")`), ""); err == nil {
+		t.Error("expected an error but got nil")
+	}
+}
+
+func TestLinePrompt(t *testing.T) {
+	var out bytes.Buffer
+	prompt := LinePrompt(strings.NewReader("\nvalue\n\n"), &out)
+
+	got, err := prompt(&Var{Name: "a", Doc: "The a."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "value" {
+		t.Errorf("got %q, want %q", got, "value")
+	}
+	got, err = prompt(&Var{Name: "b", Default: "two", HasDefault: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "two" {
+		t.Errorf("got %q, want %q", got, "two")
+	}
+	if _, err := prompt(&Var{Name: "c"}); err == nil {
+		t.Error("expected an error at the end of the input but got nil")
+	}
+
+	wantOut := "The a.\na: invalid value: a value is required\na: b [two]: c: "
+	if diff := cmp.Diff(wantOut, out.String()); diff != "" {
+		t.Errorf("got unexpected output (-want,+got):\n%s", diff)
+	}
+}
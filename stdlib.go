@@ -0,0 +1,406 @@
+package mktree
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+//
+// Standard library
+//
+// These template functions are for generating code and configuration. Functions
+// that transform a value take it as their last argument, so that they can be
+// used in pipelines such as {{ Var "name" | SnakeCase | Upper }}.
+//
+
+// stdlib returns the standard library of template functions. The random
+// functions use a source with the given seed, or the current time if it is zero.
+func stdlib(seed int64) []Option {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	r := rand.New(rand.NewSource(seed))
+	funcs := map[string]interface{}{
+		"CamelCase":    camelCase,
+		"PascalCase":   pascalCase,
+		"SnakeCase":    snakeCase,
+		"KebabCase":    kebabCase,
+		"Upper":        strings.ToUpper,
+		"Lower":        strings.ToLower,
+		"Pluralize":    pluralize,
+		"Indent":       indent,
+		"Nindent":      nindent,
+		"Trim":         strings.TrimSpace,
+		"TrimPrefix":   trimPrefix,
+		"TrimSuffix":   trimSuffix,
+		"Replace":      replace,
+		"Split":        split,
+		"Join":         join,
+		"RegexMatch":   regexMatch,
+		"RegexReplace": regexReplace,
+		"Default":      defaultValue,
+		"Coalesce":     coalesce,
+		"Ternary":      ternary,
+		"List":         list,
+		"Dict":         dict,
+		"Keys":         keys,
+		"HasKey":       hasKey,
+		"Contains":     contains,
+		"UUID":         newUUIDBuiltin(r),
+		"Random":       newRandomBuiltin(r),
+		"RandomString": newRandomStringBuiltin(r),
+		"Base64Encode": base64Encode,
+		"Base64Decode": base64Decode,
+		"Sha256":       sha256Sum,
+		"ToJSON":       toJSON,
+		"ToYAML":       toYAML,
+		"License":      License,
+	}
+	var opts []Option
+	for name, f := range funcs {
+		opts = append(opts, WithTemplateFunction(name, f))
+	}
+	return opts
+}
+
+// words splits s into words at non-alphanumeric characters and changes of case,
+// so that "httpServer", "HTTPServer" and "http_server" are all "http server".
+func words(s string) []string {
+	var words []string
+	var word []rune
+	runes := []rune(s)
+	for i, c := range runes {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+			if len(word) > 0 {
+				words = append(words, string(word))
+				word = nil
+			}
+			continue
+		}
+		if len(word) > 0 && unicode.IsUpper(c) {
+			prev := word[len(word)-1]
+			// Split before an upper case letter that follows a lower case letter
+			// or digit, or that starts a word after an acronym.
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if !unicode.IsUpper(prev) || nextLower {
+				words = append(words, string(word))
+				word = nil
+			}
+		}
+		word = append(word, c)
+	}
+	if len(word) > 0 {
+		words = append(words, string(word))
+	}
+	return words
+}
+
+func capitalize(s string) string {
+	runes := []rune(strings.ToLower(s))
+	if len(runes) > 0 {
+		runes[0] = unicode.ToUpper(runes[0])
+	}
+	return string(runes)
+}
+
+func camelCase(s string) string {
+	ws := words(s)
+	for i, w := range ws {
+		if i == 0 {
+			ws[i] = strings.ToLower(w)
+		} else {
+			ws[i] = capitalize(w)
+		}
+	}
+	return strings.Join(ws, "")
+}
+
+func pascalCase(s string) string {
+	ws := words(s)
+	for i, w := range ws {
+		ws[i] = capitalize(w)
+	}
+	return strings.Join(ws, "")
+}
+
+func snakeCase(s string) string {
+	return strings.ToLower(strings.Join(words(s), "_"))
+}
+
+func kebabCase(s string) string {
+	return strings.ToLower(strings.Join(words(s), "-"))
+}
+
+// The plurals of the nouns that do not follow the rules used by pluralize.
+var irregularPlurals = map[string]string{
+	"child":       "children",
+	"person":      "people",
+	"man":         "men",
+	"woman":       "women",
+	"mouse":       "mice",
+	"goose":       "geese",
+	"foot":        "feet",
+	"tooth":       "teeth",
+	"index":       "indices",
+	"leaf":        "leaves",
+	"knife":       "knives",
+	"life":        "lives",
+	"data":        "data",
+	"information": "information",
+	"series":      "series",
+	"species":     "species",
+	"sheep":       "sheep",
+	"fish":        "fish",
+}
+
+// pluralize returns the plural of an English noun.
+func pluralize(s string) string {
+	lower := strings.ToLower(s)
+	if plural, ok := irregularPlurals[lower]; ok {
+		if s != lower {
+			return capitalize(plural)
+		}
+		return plural
+	}
+	switch {
+	case s == "":
+		return s
+	case strings.HasSuffix(lower, "s"), strings.HasSuffix(lower, "x"), strings.HasSuffix(lower, "z"),
+		strings.HasSuffix(lower, "ch"), strings.HasSuffix(lower, "sh"):
+		return s + "es"
+	case strings.HasSuffix(lower, "y") && len(lower) > 1 && !strings.ContainsRune("aeiou", rune(lower[len(lower)-2])):
+		return s[:len(s)-1] + "ies"
+	}
+	return s + "s"
+}
+
+// indent indents every line of s by n spaces.
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+// nindent is indent preceded by a newline, for indenting a block after the end
+// of a line, as in "spec:{{ .Data.spec | ToYAML | Nindent 2 }}".
+func nindent(n int, s string) string {
+	return "\n" + indent(n, s)
+}
+
+func trimPrefix(prefix, s string) string {
+	return strings.TrimPrefix(s, prefix)
+}
+
+func trimSuffix(suffix, s string) string {
+	return strings.TrimSuffix(s, suffix)
+}
+
+func replace(old, new, s string) string {
+	return strings.ReplaceAll(s, old, new)
+}
+
+func split(sep, s string) []string {
+	return strings.Split(s, sep)
+}
+
+// join joins the elements of a list, which can be a list variable or the result
+// of List or Split.
+func join(sep string, list interface{}) (string, error) {
+	elems, err := listElems(list)
+	if err != nil {
+		return "", err
+	}
+	strs := make([]string, len(elems))
+	for i, e := range elems {
+		strs[i] = fmt.Sprint(e)
+	}
+	return strings.Join(strs, sep), nil
+}
+
+func listElems(list interface{}) ([]interface{}, error) {
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("%v is not a list", list)
+	}
+	elems := make([]interface{}, v.Len())
+	for i := range elems {
+		elems[i] = v.Index(i).Interface()
+	}
+	return elems, nil
+}
+
+func regexMatch(pattern, s string) (bool, error) {
+	return regexp.MatchString(pattern, s)
+}
+
+// regexReplace replaces the matches of pattern in s with repl, which can refer
+// to submatches as in regexp.Regexp.Expand.
+func regexReplace(pattern, repl, s string) (string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", err
+	}
+	return re.ReplaceAllString(s, repl), nil
+}
+
+// defaultValue returns v, or def if v is empty.
+func defaultValue(def, v interface{}) interface{} {
+	if truth, _ := template.IsTrue(v); !truth {
+		return def
+	}
+	return v
+}
+
+// coalesce returns the first of the values that is not empty.
+func coalesce(values ...interface{}) interface{} {
+	for _, v := range values {
+		if truth, _ := template.IsTrue(v); truth {
+			return v
+		}
+	}
+	return nil
+}
+
+// ternary returns a if cond is true and b otherwise.
+func ternary(a, b, cond interface{}) interface{} {
+	if isTrue(cond) {
+		return a
+	}
+	return b
+}
+
+func list(values ...interface{}) []interface{} {
+	return values
+}
+
+// dict returns a map of the given keys and values, which alternate.
+func dict(pairs ...interface{}) (map[string]interface{}, error) {
+	if len(pairs)%2 != 0 {
+		return nil, errors.New("expected pairs of keys and values")
+	}
+	d := map[string]interface{}{}
+	for i := 0; i < len(pairs); i += 2 {
+		key, ok := pairs[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("key %v is not a string", pairs[i])
+		}
+		d[key] = pairs[i+1]
+	}
+	return d, nil
+}
+
+// keys returns the keys of a map in order.
+func keys(d map[string]interface{}) []string {
+	var keys []string
+	for key := range d {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func hasKey(d map[string]interface{}, key string) bool {
+	_, ok := d[key]
+	return ok
+}
+
+// contains reports whether a list contains v, a map has the key v, or a string
+// contains the substring v.
+func contains(v, in interface{}) (bool, error) {
+	switch rv := reflect.ValueOf(in); rv.Kind() {
+	case reflect.String:
+		return strings.Contains(rv.String(), fmt.Sprint(v)), nil
+	case reflect.Map:
+		for _, key := range rv.MapKeys() {
+			if fmt.Sprint(key.Interface()) == fmt.Sprint(v) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	elems, err := listElems(in)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range elems {
+		if fmt.Sprint(e) == fmt.Sprint(v) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// newUUIDBuiltin returns a function that returns a random (version 4) UUID.
+func newUUIDBuiltin(r *rand.Rand) func() string {
+	return func() string {
+		var b [16]byte
+		r.Read(b[:])
+		b[6] = b[6]&0x0f | 0x40
+		b[8] = b[8]&0x3f | 0x80
+		h := hex.EncodeToString(b[:])
+		return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+	}
+}
+
+// newRandomBuiltin returns a function that returns a random integer in [0, n).
+func newRandomBuiltin(r *rand.Rand) func(int) (int, error) {
+	return func(n int) (int, error) {
+		if n <= 0 {
+			return 0, fmt.Errorf("invalid bound %d: must be positive", n)
+		}
+		return r.Intn(n), nil
+	}
+}
+
+const randomStringChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// newRandomStringBuiltin returns a function that returns a random string of n
+// letters and digits.
+func newRandomStringBuiltin(r *rand.Rand) func(int) string {
+	return func(n int) string {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = randomStringChars[r.Intn(len(randomStringChars))]
+		}
+		return string(b)
+	}
+}
+
+func base64Encode(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func base64Decode(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	return string(b), err
+}
+
+// sha256Sum returns the SHA-256 hash of s in hexadecimal.
+func sha256Sum(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// toYAML encodes v as YAML, without a trailing newline.
+func toYAML(v interface{}) (string, error) {
+	b, err := yaml.Marshal(v)
+	return strings.TrimSuffix(string(b), "\n"), err
+}
@@ -0,0 +1,177 @@
+package mktree
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func execStdlib(t *testing.T, seed int64, text string, data interface{}) (string, error) {
+	t.Helper()
+	thr := newThread("layout.tree", builtins(seed)...)
+	tmpl, err := template.New("test").Funcs(thr.funcs(nil)).Parse(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	err = tmpl.Execute(&b, data)
+	return b.String(), err
+}
+
+func TestStdlib(t *testing.T) {
+	data := map[string]interface{}{
+		"list": []string{"api", "web"},
+		"dict": map[string]interface{}{"b": 2, "a": "x"},
+	}
+	tests := []struct {
+		text string
+		want string
+	}{
+		{`{{ CamelCase "http_server-name" }}`, "httpServerName"},
+		{`{{ PascalCase "HTTPServer" }}`, "HttpServer"},
+		{`{{ SnakeCase "myHTTPServer2Go" }}`, "my_http_server2_go"},
+		{`{{ KebabCase "Hello World" }}`, "hello-world"},
+		{`{{ "abc" | Upper }} {{ "ABC" | Lower }}`, "ABC abc"},
+		{`{{ Pluralize "service" }} {{ Pluralize "box" }} {{ Pluralize "Policy" }} {{ Pluralize "day" }} {{ Pluralize "Person" }}`, "services boxes Policies days People"},
+		{`{{ "a\nb" | Indent 2 }}`, "  a\n  b"},
+		{`x:{{ "a" | Nindent 2 }}`, "x:\n  a"},
+		{`{{ Trim " a " }}|{{ TrimPrefix "v" "v1.0" }}|{{ TrimSuffix ".go" "a.go" }}`, "a|1.0|a"},
+		{`{{ Replace "-" "_" "a-b-c" }}`, "a_b_c"},
+		{`{{ Split "," "a,b" | Join "+" }} {{ Join ", " .list }}`, "a+b api, web"},
+		{`{{ RegexMatch "^v[0-9]+$" "v12" }} {{ RegexReplace "(\\w+)@(\\w+)" "$2 at $1" "me@host" }}`, "true host at me"},
+		{`{{ Default "none" "" }} {{ Default "none" "x" }} {{ Coalesce "" 0 "c" }}`, "none x c"},
+		{`{{ Ternary "yes" "no" true }} {{ Ternary "yes" "no" "false" }}`, "yes no"},
+		{`{{ range List 1 "b" }}{{ . }}{{ end }}`, "1b"},
+		{`{{ $d := Dict "k" "v" "n" 1 }}{{ $d.k }}{{ $d.n }} {{ HasKey $d "k" }} {{ HasKey $d "z" }}`, "v1 true false"},
+		{`{{ Keys .dict | Join "," }}`, "a,b"},
+		{`{{ Contains "web" .list }} {{ Contains "db" .list }} {{ Contains "ell" "hello" }} {{ Contains "a" .dict }}`, "true false true true"},
+		{`{{ Base64Encode "hello" }} {{ Base64Decode "aGVsbG8=" }}`, "aGVsbG8= hello"},
+		{`{{ Sha256 "" }}`, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{`{{ ToJSON .dict }}`, `{"a":"x","b":2}`},
+		{`{{ ToYAML .dict }}`, "a: x\nb: 2"},
+	}
+	for _, test := range tests {
+		t.Run(test.text, func(t *testing.T) {
+			got, err := execStdlib(t, 1, test.text, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestStdlib_Errors(t *testing.T) {
+	for _, text := range []string{
+		`{{ RegexMatch "(" "a" }}`,
+		`{{ Dict "k" }}`,
+		`{{ Dict 1 2 }}`,
+		`{{ Random 0 }}`,
+		`{{ Join "," "a" }}`,
+		`{{ Base64Decode "!" }}`,
+		`{{ License "GPL-9.0" "me" }}`,
+	} {
+		if _, err := execStdlib(t, 1, text, nil); err == nil {
+			t.Errorf("%s wanted an error but got nil", text)
+		}
+	}
+}
+
+func TestStdlib_Seed(t *testing.T) {
+	const text = `{{ UUID }} {{ Random 1000 }} {{ RandomString 8 }}`
+	a, err := execStdlib(t, 42, text, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := execStdlib(t, 42, text, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Errorf("got %q and %q with the same seed, want the same values", a, b)
+	}
+	c, err := execStdlib(t, 43, text, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == c {
+		t.Errorf("got %q with different seeds, want different values", a)
+	}
+
+	fields := strings.Fields(a)
+	uuid := fields[0]
+	if len(uuid) != 36 || uuid[14] != '4' || !strings.ContainsRune("89ab", rune(uuid[19])) {
+		t.Errorf("UUID got %q, want a version 4 UUID", uuid)
+	}
+	if len(fields[2]) != 8 {
+		t.Errorf("RandomString 8 got %q", fields[2])
+	}
+}
+
+func TestLicense(t *testing.T) {
+	year := strconv.Itoa(time.Now().Year())
+	for _, id := range Licenses() {
+		t.Run(id, func(t *testing.T) {
+			text, err := License(id, "Jane Doe")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, placeholder := range []string{"<year>", "<copyright holders>", "[yyyy]", "[name of copyright owner]"} {
+				if strings.Contains(text, placeholder) {
+					t.Errorf("License(%q) left the placeholder %s in the text", id, placeholder)
+				}
+			}
+			if id == "Unlicense" {
+				return // It has no copyright notice.
+			}
+			if !strings.Contains(text, year) || !strings.Contains(text, "Jane Doe") {
+				t.Errorf("License(%q) does not contain the year and holder:\n%s", id, text)
+			}
+		})
+	}
+	if n := len(Licenses()); n != 7 {
+		t.Errorf("got %d licenses, want 7", n)
+	}
+
+	mit, _ := License("MIT", "Jane Doe")
+	if want := "Copyright (c) " + year + " Jane Doe"; !strings.Contains(mit, want) {
+		t.Errorf("License(MIT) does not contain %q:\n%s", want, mit)
+	}
+	apache, _ := License("Apache-2.0", "Jane Doe")
+	if want := "Copyright " + year + " Jane Doe"; !strings.Contains(apache, want) {
+		t.Errorf("License(Apache-2.0) does not contain %q", want)
+	}
+}
+
+func TestInterpreter_StdlibInConditions(t *testing.T) {
+	src := writeSourceFiles(t, map[string]string{
+		"layout.tree": `
+(var "name" (@default "myService"))
+(var "license" (@default "MIT"))
+(var "width" (@default "2"))
+(when (RegexMatch "^my" name)
+  (file "%(name).go" (@template "main.tmpl")))
+(unless (HasKey (Dict "MIT" 1) license)
+  (file "unexpected"))
+(when (and (eq (Random 1) 0) (eq (Indent width "a") "  a"))
+  (file "numbers"))
+`,
+		"main.tmpl": `package {{ Var "name" | SnakeCase }}`,
+	})
+	root := filepath.Join(tempDir(t), "out")
+	i := &Interpreter{Root: root}
+	if err := i.ExecFile(nil, filepath.Join(src, "layout.tree")); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, OSFS{}, filepath.Join(root, "myService.go"), defaultFileMode, "package my_service")
+	assertFile(t, OSFS{}, filepath.Join(root, "numbers"), defaultFileMode, "")
+	if _, err := os.Lstat(filepath.Join(root, "unexpected")); !os.IsNotExist(err) {
+		t.Errorf("unless created a file for a true condition: %v", err)
+	}
+}
@@ -1,10 +1,34 @@
 package mktree
 
-import "path/filepath"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+// defaultPartialsDir is the directory of partials used if none are given,
+// relative to the directory of the main source file.
+const defaultPartialsDir = "partials"
 
 type thread struct {
 	templateFuncs map[string]interface{}
 	sourceRoot    string
+	fs            FS
+
+	// templatePath are the directories searched for templates that are not
+	// found relative to the source file that names them.
+	templatePath []string
+
+	// partialsDirs are the directories of partials: templates that are parsed
+	// with every template. If nil, defaultPartialsDir is used if it exists.
+	partialsDirs []string
+	partials     []string // The files in partialsDirs, once they are read.
+
+	// prompt asks for the value of a variable that is substituted but is not
+	// declared or given, if it is not nil. The answers are kept in answers.
+	prompt  func(*Var) (string, error)
+	answers map[string]string
 }
 
 func newThread(filename string, opts ...Option) *thread {
@@ -13,13 +37,75 @@ func newThread(filename string, opts ...Option) *thread {
 		sourceRoot = "."
 	}
 
-	t := &thread{sourceRoot: sourceRoot}
+	t := &thread{sourceRoot: sourceRoot, fs: OSFS{}}
 	for _, o := range opts {
 		o.apply(t)
 	}
 	return t
 }
 
+// funcs returns the template functions for source evaluated with the given
+// variables, for which the Var builtin returns the values.
+func (thr *thread) funcs(vars map[string]string) template.FuncMap {
+	funcs := template.FuncMap{"Var": newVarBuiltin(vars)}
+	for name, f := range thr.templateFuncs {
+		funcs[name] = f
+	}
+	return funcs
+}
+
+// findTemplate returns the path to a template named in source, which is at path
+// relative to sourceRoot unless it is only found in the template search path.
+func (thr *thread) findTemplate(path, name string) string {
+	if filepath.IsAbs(name) || fileExists(filepath.Join(thr.sourceRoot, path)) {
+		return path
+	}
+	for _, dir := range thr.templatePath {
+		found := filepath.Join(dir, name)
+		if !fileExists(found) {
+			continue
+		}
+		if abs, err := filepath.Abs(found); err == nil {
+			return abs
+		}
+		return found
+	}
+	return path
+}
+
+// partialFiles returns the files in the partials directories, in order.
+func (thr *thread) partialFiles() ([]string, error) {
+	if thr.partials != nil {
+		return thr.partials, nil
+	}
+	dirs := thr.partialsDirs
+	if dirs == nil {
+		dir := filepath.Join(thr.sourceRoot, defaultPartialsDir)
+		if stat, err := os.Stat(dir); err == nil && stat.IsDir() {
+			dirs = []string{dir}
+		}
+	}
+	partials := []string{}
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.Mode().IsRegular() && e.Name()[0] != '.' {
+				partials = append(partials, filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+	thr.partials = partials
+	return partials, nil
+}
+
+func fileExists(filename string) bool {
+	stat, err := os.Stat(filename)
+	return err == nil && !stat.IsDir()
+}
+
 func (thr *thread) addTemplateFunc(name string, f interface{}) {
 	if thr.templateFuncs == nil {
 		thr.templateFuncs = map[string]interface{}{}
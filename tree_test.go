@@ -1,9 +1,15 @@
 package mktree
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/kendalharland/mktree/parse"
 )
 
 func TestExecTemplateFile(t *testing.T) {
@@ -22,7 +28,7 @@ func TestExecTemplateFile(t *testing.T) {
 	funcMap := map[string]interface{}{
 		"CustomFunction": func() string { return "Tester" },
 	}
-	content, err := execTemplateFile(f.Name(), funcMap)
+	content, err := execTemplateFile(f.Name(), nil, funcMap, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -30,3 +36,152 @@ func TestExecTemplateFile(t *testing.T) {
 		t.Fatalf("wanted 'Hello Tester' but got %q", content)
 	}
 }
+
+func TestInterpreter_TemplateData(t *testing.T) {
+	src := writeSourceFiles(t, map[string]string{
+		"layout.tree": `
+(var "project" (@default "hello"))
+(dir "cmd" (for name in (list "a") (file "%(name).go" (@perms 0640) (@template "main.tmpl"))))
+(file "missing" (@template "missing.tmpl"))
+`,
+		"main.tmpl":    `{{ .Vars.project }} {{ .Vars.name }} {{ range .Vars.services }}{{ . }},{{ end }} {{ .File.Name }} {{ .File.Path }} {{ printf "%04o" .File.Perms }} {{ .Dir.Name }}`,
+		"missing.tmpl": `{{ .Vars.missing }}`,
+		"vars.json":    `{"services": ["api", "web"]}`,
+	})
+	root := filepath.Join(tempDir(t), "out")
+	i := &Interpreter{Root: root, VarsFiles: []string{filepath.Join(src, "vars.json")}}
+	p, err := i.PlanFile(nil, filepath.Join(src, "layout.tree"))
+	if err == nil {
+		t.Fatalf("PlanFile wanted an error for an undefined variable but got %v", p)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(src, "missing.tmpl"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.ExecFile(nil, filepath.Join(src, "layout.tree")); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(root, "cmd/a.go")
+	want := fmt.Sprintf("hello a api,web, a.go %s 0640 cmd", filename)
+	assertFile(t, OSFS{}, filename, 0640, want)
+}
+
+func TestInterpreter_TemplateParams(t *testing.T) {
+	src := writeSourceFiles(t, map[string]string{
+		"layout.tree": `
+(file "a.go" (@template "pkg.tmpl") (@data (name "a") (imports (list "fmt" "os"))))
+(file "b.go" (@template "pkg.tmpl") (@data (name "b")))
+`,
+		"pkg.tmpl": `package {{ .Data.name }}{{ with .Data.imports }} // {{ range . }}{{ . }} {{ end }}{{ end }}`,
+	})
+	root := filepath.Join(tempDir(t), "out")
+	i := &Interpreter{Root: root}
+	if err := i.ExecFile(nil, filepath.Join(src, "layout.tree")); err == nil {
+		t.Fatal("ExecFile wanted an error for a missing parameter but got nil")
+	}
+
+	src = writeSourceFiles(t, map[string]string{
+		"layout.tree": `
+(file "a.go" (@template "pkg.tmpl") (@data (name "a") (imports (list "fmt" "os"))))
+(file "b.go" (@template "pkg.tmpl") (@data (name "b") (imports "")))
+`,
+		"pkg.tmpl": `package {{ .Data.name }}{{ with .Data.imports }} // {{ range . }}{{ . }} {{ end }}{{ end }}`,
+	})
+	if err := i.ExecFile(nil, filepath.Join(src, "layout.tree")); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, OSFS{}, filepath.Join(root, "a.go"), defaultFileMode, "package a // fmt os ")
+	assertFile(t, OSFS{}, filepath.Join(root, "b.go"), defaultFileMode, "package b")
+}
+
+func TestInterpreter_TemplatePartialsAndPath(t *testing.T) {
+	src := writeSourceFiles(t, map[string]string{
+		"layout.tree": `
+(file "a" (@template "a.tmpl"))
+(file "b" (@template "shared/b.tmpl"))
+`,
+		"a.tmpl": `{{ template "header" . }}a`,
+		"partials/header.tmpl": `{{ define "header" }}// {{ .File.Name }}
+{{ end }}`,
+		"org/shared/b.tmpl":        `{{ template "header" . }}{{ template "footer.tmpl" }}`,
+		"org/partials/footer.tmpl": `footer`,
+	})
+	root := filepath.Join(tempDir(t), "out")
+	i := &Interpreter{Root: root, TemplatePath: []string{filepath.Join(src, "org")}}
+	if err := i.ExecFile(nil, filepath.Join(src, "layout.tree")); err == nil {
+		t.Fatal("ExecFile wanted an error for an undefined partial but got nil")
+	}
+
+	i.TemplatePartials = []string{filepath.Join(src, "partials"), filepath.Join(src, "org/partials")}
+	if err := i.ExecFile(nil, filepath.Join(src, "layout.tree")); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, OSFS{}, filepath.Join(root, "a"), defaultFileMode, "// a\na")
+	assertFile(t, OSFS{}, filepath.Join(root, "b"), defaultFileMode, "// b\nfooter")
+}
+
+func TestInterpreter_TemplateErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		wantFile string // The file the error is reported in.
+		wantLine int
+		wantCol  int
+		wantMsg  string // The template file named in the message.
+	}{
+		{
+			name: "exec_error",
+			files: map[string]string{
+				"layout.tree": "(dir \"src\"\n  (file \"a.go\" (@template \"a.tmpl\")))",
+				"a.tmpl":      `{{ .Data.missing }}`,
+			},
+			wantFile: "layout.tree",
+			wantLine: 2,
+			wantCol:  17,
+			wantMsg:  "a.tmpl",
+		},
+		{
+			name: "parse_error",
+			files: map[string]string{
+				"layout.tree": `(file "a" (@template "a.tmpl"))`,
+				"a.tmpl":      `{{ if }}`,
+			},
+			wantFile: "layout.tree",
+			wantLine: 1,
+			wantCol:  12,
+			wantMsg:  "a.tmpl",
+		},
+		{
+			name: "included",
+			files: map[string]string{
+				"layout.tree": `(include "sub/b.tree")`,
+				"sub/b.tree":  "\n(file \"b\" (@template \"b.tmpl\"))",
+				"sub/b.tmpl":  `{{ template "missing" }}`,
+			},
+			wantFile: "b.tree",
+			wantLine: 2,
+			wantCol:  12,
+			wantMsg:  filepath.Join("sub", "b.tmpl"),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := writeSourceFiles(t, test.files)
+			root := filepath.Join(tempDir(t), "out")
+			i := &Interpreter{Root: root}
+			err := i.ExecFile(nil, filepath.Join(src, "layout.tree"))
+
+			var diags parse.Diagnostics
+			if !errors.As(err, &diags) || len(diags) != 1 {
+				t.Fatalf("ExecFile wanted one diagnostic but got %v", err)
+			}
+			d := diags[0]
+			if !strings.HasSuffix(d.Filename, string(filepath.Separator)+test.wantFile) || d.Line != test.wantLine || d.Column != test.wantCol {
+				t.Fatalf("ExecFile got diagnostic at %s:%d:%d, want %s:%d:%d: %v", d.Filename, d.Line, d.Column, test.wantFile, test.wantLine, test.wantCol, d)
+			}
+			if !strings.Contains(d.Message, filepath.Join(src, test.wantMsg)) || !strings.Contains(d.Message, root) {
+				t.Errorf("ExecFile got %q, want the template and output paths", d.Message)
+			}
+		})
+	}
+}
@@ -0,0 +1,356 @@
+package mktree
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/kendalharland/mktree/parse"
+)
+
+// A unit is a parsed source file.
+type unit struct {
+	filename string // The path used to read the file and in diagnostics.
+	source   []byte
+	tree     *parse.Tree
+
+	// dir is the directory containing the file, relative to the directory of
+	// the main source file unless it is absolute.
+	dir string
+
+	// The units included by each include expression in the file.
+	includes map[*parse.SExpr]*unit
+
+	// defined are the fragments defined in the file, and fragments are the ones
+	// that can be used in it: those defined in it and in the files it imports.
+	defined   map[string]*fragment
+	fragments map[string]*fragment
+}
+
+// path returns the path to a file named relative to u, relative to the directory
+// of the main source file unless it is absolute.
+func (u *unit) path(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(u.dir, name)
+}
+
+// A fragment is a named list of entities declared with define.
+type fragment struct {
+	name   string
+	unit   *unit
+	params []string     // The names of the variables bound to the arguments.
+	body   []*parse.Arg // The entities.
+}
+
+// loader loads a source file and the files it includes and imports.
+type loader struct {
+	stderr  io.Writer
+	units   map[string]*unit // Keyed by absolute filename.
+	order   []*unit          // In the order they were loaded.
+	loading []*unit          // The files being loaded, to detect cycles.
+}
+
+func newLoader(stderr io.Writer) *loader {
+	return &loader{stderr: stderr, units: map[string]*unit{}}
+}
+
+// load parses source, read from the named file in dir, and loads the files it
+// includes and imports. If the source cannot be parsed, the partially parsed
+// unit is returned with the error.
+func (l *loader) load(filename, dir string, source []byte) (*unit, error) {
+	p := &parse.Parser{Filename: filename, Stderr: l.stderr}
+	tree, err := p.Parse(bytes.NewReader(source))
+	if tree == nil {
+		return nil, err
+	}
+	u := &unit{
+		filename:  filename,
+		dir:       dir,
+		source:    source,
+		tree:      tree,
+		includes:  map[*parse.SExpr]*unit{},
+		defined:   map[string]*fragment{},
+		fragments: map[string]*fragment{},
+	}
+	l.units[unitKey(filename)] = u
+	l.order = append(l.order, u)
+	if err != nil {
+		return u, err
+	}
+
+	l.loading = append(l.loading, u)
+	defer func() { l.loading = l.loading[:len(l.loading)-1] }()
+	if err := l.loadDecls(u); err != nil {
+		return u, diagnose(u.filename, u.source, err)
+	}
+	return u, nil
+}
+
+// loadDecls loads the files that u includes and imports and records the
+// fragments that can be used in u.
+func (l *loader) loadDecls(u *unit) error {
+	for _, e := range u.tree.SExprs {
+		if e.Literal.Token.Kind != parse.DefineTokenKind {
+			continue
+		}
+		f, err := evalDefine(u, e)
+		if err != nil {
+			return err
+		}
+		if _, ok := u.defined[f.name]; ok {
+			return evalErrorf(e.Args[0].Token, codeInvalidArgument, "fragment %q is already defined", f.name)
+		}
+		u.defined[f.name] = f
+		u.fragments[f.name] = f
+	}
+	for _, e := range u.tree.SExprs {
+		if e.Literal.Token.Kind != parse.ImportTokenKind {
+			continue
+		}
+		imported, err := l.loadFile(u, e)
+		if err != nil {
+			return err
+		}
+		for name, f := range imported.defined {
+			if _, ok := u.fragments[name]; ok {
+				return evalErrorf(e.Args[0].Token, codeInvalidArgument, "fragment %q is already defined", name)
+			}
+			u.fragments[name] = f
+		}
+	}
+	return l.loadIncludes(u, u.tree.SExprs)
+}
+
+func (l *loader) loadIncludes(u *unit, es []*parse.SExpr) error {
+	for _, e := range es {
+		switch e.Literal.Token.Kind {
+		case parse.VarTokenKind, parse.ImportTokenKind:
+			continue
+		case parse.IncludeTokenKind:
+			included, err := l.loadFile(u, e)
+			if err != nil {
+				return err
+			}
+			u.includes[e] = included
+			continue
+		}
+		var children []*parse.SExpr
+		for _, arg := range e.Args {
+			if arg.SExpr != nil {
+				children = append(children, arg.SExpr)
+			}
+		}
+		if err := l.loadIncludes(u, children); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadFile loads the file named by an include or import expression in u.
+func (l *loader) loadFile(u *unit, e *parse.SExpr) (*unit, error) {
+	kind := e.Literal.Token.Kind
+	if len(e.Args) != 1 {
+		return nil, evalErrorf(e.Literal.Token, codeMissingArgument, "expected a filename")
+	}
+	name, err := evalString(constScope, e.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	filename, dir := name, filepath.Dir(name)
+	if !filepath.IsAbs(name) {
+		filename = filepath.Join(filepath.Dir(u.filename), name)
+		dir = u.path(dir)
+	}
+
+	key := unitKey(filename)
+	for i, loading := range l.loading {
+		if unitKey(loading.filename) != key {
+			continue
+		}
+		var cycle []string
+		for _, v := range l.loading[i:] {
+			cycle = append(cycle, v.filename)
+		}
+		cycle = append(cycle, filename)
+		return nil, evalErrorf(e.Args[0].Token, codeInvalidArgument, "%s cycle: %s", kind, strings.Join(cycle, " -> "))
+	}
+	if loaded, ok := l.units[key]; ok {
+		return loaded, nil
+	}
+
+	source, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, evalErrorf(e.Args[0].Token, codeInvalidArgument, "cannot %s %s: %v", kind, name, err)
+	}
+	return l.load(filename, dir, source)
+}
+
+// vars returns the variables declared in the loaded files. A variable declared in
+// more than one file takes the first declaration, starting with the main file.
+func (l *loader) vars() ([]*Var, error) {
+	var vars []*Var
+	seen := map[string]bool{}
+	for _, u := range l.order {
+		decls, err := evalVars(u.tree)
+		if err != nil {
+			return nil, diagnose(u.filename, u.source, err)
+		}
+		for _, v := range decls {
+			if !seen[v.Name] {
+				seen[v.Name] = true
+				vars = append(vars, v)
+			}
+		}
+	}
+	return vars, nil
+}
+
+func unitKey(filename string) string {
+	if filename == "" {
+		return ""
+	}
+	if abs, err := filepath.Abs(filename); err == nil {
+		return abs
+	}
+	return filepath.Clean(filename)
+}
+
+func evalDefine(u *unit, e *parse.SExpr) (*fragment, error) {
+	if len(e.Args) < 1 {
+		return nil, evalErrorf(e.Literal.Token, codeMissingArgument, "expected a fragment name")
+	}
+	name, err := evalIdent(e.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	f := &fragment{name: name, unit: u, body: e.Args[1:]}
+	if params := fragmentParams(e); params != nil {
+		if f.params, err = evalParams(params); err != nil {
+			return nil, err
+		}
+		f.body = e.Args[2:]
+	}
+	for _, arg := range f.body {
+		if arg.SExpr == nil {
+			return nil, evalErrorf(arg.Token, codeInvalidExpression, "unexpected %v in define", arg.Token.Value)
+		}
+	}
+	return f, nil
+}
+
+// fragmentParams returns the parameter list of a define expression, if it has
+// one. The list follows the fragment's name and starts with an identifier, which
+// distinguishes it from the entities.
+func fragmentParams(e *parse.SExpr) *parse.SExpr {
+	if len(e.Args) < 2 || e.Args[1].SExpr == nil {
+		return nil
+	}
+	if params := e.Args[1].SExpr; params.Literal.Token.Kind == parse.IdentTokenKind {
+		return params
+	}
+	return nil
+}
+
+// evalParams evaluates a parameter list such as (name path), which is parsed as
+// an s-expression whose head is the first parameter.
+func evalParams(e *parse.SExpr) ([]string, error) {
+	var params []string
+	seen := map[string]bool{}
+	for _, a := range append([]*parse.Arg{{Token: e.Literal.Token, Literal: e.Literal}}, e.Args...) {
+		param, err := evalIdent(a)
+		if err != nil {
+			return nil, err
+		}
+		if seen[param] {
+			return nil, evalErrorf(a.Token, codeInvalidArgument, "parameter %q is already declared", param)
+		}
+		seen[param] = true
+		params = append(params, param)
+	}
+	return params, nil
+}
+
+// evalInclude evaluates the entities in an included file as children of parent.
+func evalInclude(sc *scope, parent *dir, e *parse.SExpr) error {
+	u, ok := sc.unit.includes[e]
+	if !ok {
+		return evalErrorf(e.Literal.Token, codeInvalidExpression, "include was not loaded")
+	}
+	return evalIn(sc, u, nil, func(sc *scope) error {
+		return evalTree(sc, u.tree, parent)
+	})
+}
+
+// evalUse evaluates the entities in a fragment as children of parent.
+func evalUse(sc *scope, parent *dir, e *parse.SExpr) error {
+	if len(e.Args) < 1 {
+		return evalErrorf(e.Literal.Token, codeMissingArgument, "expected a fragment name")
+	}
+	name, err := evalIdent(e.Args[0])
+	if err != nil {
+		return err
+	}
+	f, ok := sc.unit.fragments[name]
+	if !ok {
+		return evalErrorf(e.Args[0].Token, codeInvalidArgument, "undefined fragment %q", name)
+	}
+	for s := sc; s != nil; s = s.parent {
+		if s.fragment == f {
+			return evalErrorf(e.Args[0].Token, codeInvalidArgument, "fragment %q uses itself", name)
+		}
+	}
+	args := e.Args[1:]
+	if len(args) != len(f.params) {
+		return evalErrorf(e.Literal.Token, codeInvalidArgument, "fragment %q takes %d arguments but got %d", name, len(f.params), len(args))
+	}
+
+	// The body can refer to the variables of the tree and the arguments, but
+	// not to the arguments of the fragments using it.
+	vars := map[string]string{}
+	for name, value := range sc.root().vars {
+		vars[name] = value
+	}
+	for i, arg := range args {
+		value, err := evalString(sc, arg)
+		if err != nil {
+			return err
+		}
+		vars[f.params[i]] = value
+	}
+	return evalIn(sc, f.unit, f, func(sc *scope) error {
+		sc.vars = vars
+		for _, arg := range f.body {
+			if err := evalDirChild(sc, parent, arg.SExpr); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// evalIn calls eval with a child scope of sc for evaluating source in u, such as
+// the body of fragment f. Errors are reported against the source of u.
+func evalIn(sc *scope, u *unit, f *fragment, eval func(*scope) error) error {
+	child := *sc
+	child.unit = u
+	child.fragment = f
+	child.parent = sc
+	err := eval(&child)
+	if err != nil && u != sc.unit {
+		return diagnose(u.filename, u.source, err)
+	}
+	return err
+}
+
+func evalIdent(a *parse.Arg) (string, error) {
+	l := a.Literal
+	if l == nil || l.Token.Kind != parse.IdentTokenKind {
+		return "", evalErrorf(a.Token, codeInvalidArgument, "%v is not an identifier", a.Token)
+	}
+	return l.Token.Value, nil
+}
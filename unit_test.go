@@ -0,0 +1,213 @@
+package mktree
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kendalharland/mktree/parse"
+)
+
+func writeSourceFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := tempDir(t)
+	for name := range files {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(name)), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeFiles(root, files); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestInterpreter_Include(t *testing.T) {
+	src := writeSourceFiles(t, map[string]string{
+		"layout.tree": `
+(var "name")
+(include "common/base.tree")
+(dir "svc" (include "common/base.tree"))
+`,
+		"common/base.tree": `
+(var "license" (@default "MIT"))
+(file "LICENSE" (@template "license.tmpl"))
+(file "README" (@contents "%(name)"))
+`,
+		"common/license.tmpl": `{{ Var "license" }}`,
+	})
+	root := filepath.Join(tempDir(t), "out")
+	i := &Interpreter{Root: root, Vars: map[string]string{"name": "hello"}}
+	if err := i.ExecFile(nil, filepath.Join(src, "layout.tree")); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{root, filepath.Join(root, "svc")} {
+		assertFile(t, OSFS{}, filepath.Join(dir, "LICENSE"), defaultFileMode, "MIT")
+		assertFile(t, OSFS{}, filepath.Join(dir, "README"), defaultFileMode, "hello")
+	}
+
+	vars, err := i.VarsFile(nil, filepath.Join(src, "layout.tree"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vars) != 2 || vars[0].Name != "name" || vars[1].Name != "license" {
+		t.Errorf("VarsFile got %+v, want the variables of both files", vars)
+	}
+}
+
+func TestInterpreter_Fragments(t *testing.T) {
+	src := writeSourceFiles(t, map[string]string{
+		"layout.tree": `
+(import "fragments.tree")
+(define readme (file "README" (@contents "%(name)")))
+(dir "a" (use readme) (use license))
+(use license)
+`,
+		"fragments.tree": `
+(define license (file "LICENSE" (@template "license.tmpl")))
+(file "not-emitted")
+`,
+		"license.tmpl": `MIT`,
+	})
+	root := filepath.Join(tempDir(t), "out")
+	i := &Interpreter{Root: root, Vars: map[string]string{"name": "hello"}}
+	if err := i.ExecFile(nil, filepath.Join(src, "layout.tree")); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, OSFS{}, filepath.Join(root, "a/README"), defaultFileMode, "hello")
+	assertFile(t, OSFS{}, filepath.Join(root, "a/LICENSE"), defaultFileMode, "MIT")
+	assertFile(t, OSFS{}, filepath.Join(root, "LICENSE"), defaultFileMode, "MIT")
+	if _, err := os.Lstat(filepath.Join(root, "not-emitted")); !os.IsNotExist(err) {
+		t.Errorf("imported file's entities were created: %v", err)
+	}
+}
+
+func TestInterpreter_LoadErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		wantFile string // The file the error is reported in.
+		wantLine int
+	}{
+		{
+			name: "include_cycle",
+			files: map[string]string{
+				"layout.tree": `(include "a.tree")`,
+				"a.tree":      "(file \"a\")\n(include \"layout.tree\")",
+			},
+			wantFile: "a.tree",
+			wantLine: 2,
+		},
+		{
+			name: "include_self",
+			files: map[string]string{
+				"layout.tree": `(dir "a" (include "layout.tree"))`,
+			},
+			wantFile: "layout.tree",
+			wantLine: 1,
+		},
+		{
+			name: "import_cycle",
+			files: map[string]string{
+				"layout.tree": `(import "a.tree")`,
+				"a.tree":      `(import "layout.tree")`,
+			},
+			wantFile: "a.tree",
+			wantLine: 1,
+		},
+		{
+			name: "include_missing_file",
+			files: map[string]string{
+				"layout.tree": "\n(include \"missing.tree\")",
+			},
+			wantFile: "layout.tree",
+			wantLine: 2,
+		},
+		{
+			name: "include_syntax_error",
+			files: map[string]string{
+				"layout.tree": `(include "a.tree")`,
+				"a.tree":      "(file \"a\")\n(file \"b)",
+			},
+			wantFile: "a.tree",
+			wantLine: 2,
+		},
+		{
+			name: "include_path_with_variable",
+			files: map[string]string{
+				"layout.tree": `(include "%(name).tree")`,
+			},
+			wantFile: "layout.tree",
+			wantLine: 1,
+		},
+		{
+			name: "included_eval_error",
+			files: map[string]string{
+				"layout.tree": `(include "a.tree")`,
+				"a.tree":      "\n\n(file \"a\" (@perms \"nan\"))",
+			},
+			wantFile: "a.tree",
+			wantLine: 3,
+		},
+		{
+			name: "fragment_eval_error",
+			files: map[string]string{
+				"layout.tree": "(import \"a.tree\")\n(use bad)",
+				"a.tree":      "\n(define bad (file (@perms 0755)))",
+			},
+			wantFile: "a.tree",
+			wantLine: 2,
+		},
+		{
+			name: "fragment_undefined",
+			files: map[string]string{
+				"layout.tree": "(define a (file \"a\"))\n(use b)",
+			},
+			wantFile: "layout.tree",
+			wantLine: 2,
+		},
+		{
+			name: "fragment_defined_twice",
+			files: map[string]string{
+				"layout.tree": "(import \"a.tree\")\n(define a (file \"a\"))",
+				"a.tree":      `(define a (file "b"))`,
+			},
+			wantFile: "layout.tree",
+			wantLine: 1,
+		},
+		{
+			name: "fragment_uses_itself",
+			files: map[string]string{
+				"layout.tree": "(define a (dir \"a\" (use b)))\n(define b (use a))\n(use a)",
+			},
+			wantFile: "layout.tree",
+			wantLine: 2,
+		},
+		{
+			name: "define_not_at_top_level",
+			files: map[string]string{
+				"layout.tree": `(dir "a" (define b (file "b")))`,
+			},
+			wantFile: "layout.tree",
+			wantLine: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := writeSourceFiles(t, test.files)
+			i := &Interpreter{Root: filepath.Join(tempDir(t), "out")}
+			_, err := i.InterpretFile(nil, filepath.Join(src, "layout.tree"))
+
+			var diags parse.Diagnostics
+			if !errors.As(err, &diags) || len(diags) != 1 {
+				t.Fatalf("InterpretFile wanted one diagnostic but got %v", err)
+			}
+			d := diags[0]
+			if !strings.HasSuffix(d.Filename, string(filepath.Separator)+test.wantFile) || d.Line != test.wantLine {
+				t.Fatalf("InterpretFile got diagnostic at %s:%d, want %s:%d: %v", d.Filename, d.Line, test.wantFile, test.wantLine, d)
+			}
+		})
+	}
+}
@@ -0,0 +1,430 @@
+package mktree
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/kendalharland/mktree/parse"
+)
+
+var errInvalidVar = errors.New("invalid value for variable")
+
+// Var is a variable declared in source with a var expression:
+//
+//	(var "project_name" (@default "hello") (@doc "The name of the project."))
+//
+// Declarations are read before variables are substituted, so they cannot refer
+// to other variables.
+type Var struct {
+	Name string
+	Doc  string
+
+	// Default is the value used if the variable is not set in Interpreter.Vars.
+	// A variable without a default must be set unless undefined variables are
+	// allowed.
+	Default    string
+	HasDefault bool
+
+	// Constraints on the value. See Validate.
+	Type    VarType
+	Pattern string   // A regular expression that must match the whole value.
+	Choices []string // The allowed values, if not empty.
+	MinLen  int      // The minimum length of the value in characters.
+	MaxLen  int      // The maximum length of the value in characters, if not zero.
+
+	re *regexp.Regexp // Pattern, if it was compiled when the declaration was read.
+}
+
+// VarType is the type of the value of a variable.
+type VarType string
+
+const (
+	VarString VarType = "string"
+	VarInt    VarType = "int"
+	VarBool   VarType = "bool" // One of the values accepted by strconv.ParseBool.
+
+	// VarList is a list of strings. Given as a string, a list is separated by
+	// commas. The other constraints apply to each element.
+	VarList VarType = "list"
+)
+
+// Validate returns an error if value does not have the variable's type or does
+// not satisfy its constraints. The value of a list variable is split at commas.
+func (v *Var) Validate(value string) error {
+	if v.Type == VarList {
+		return v.ValidateList(splitList(value))
+	}
+	cs, err := v.constraints()
+	if err != nil {
+		return err
+	}
+	for _, c := range cs {
+		if !c.ok(value) {
+			return fmt.Errorf("%q is not %s", value, c.desc)
+		}
+	}
+	return nil
+}
+
+// ValidateList returns an error if the variable is not a list or an element of
+// list does not satisfy its constraints.
+func (v *Var) ValidateList(list []string) error {
+	if v.Type != VarList {
+		return errors.New("a list is not allowed")
+	}
+	cs, err := v.constraints()
+	if err != nil {
+		return err
+	}
+	for _, value := range list {
+		for _, c := range cs {
+			if !c.ok(value) {
+				return fmt.Errorf("element %q is not %s", value, c.desc)
+			}
+		}
+	}
+	return nil
+}
+
+// splitList returns the elements of a list given as a string: the values
+// separated by commas, without surrounding whitespace.
+func splitList(s string) []string {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	list := strings.Split(s, ",")
+	for i, value := range list {
+		list[i] = strings.TrimSpace(value)
+	}
+	return list
+}
+
+// Constraints describes the values allowed by the variable's type and
+// constraints, such as "an integer" or "at most 10 characters long".
+func (v *Var) Constraints() []string {
+	var descs []string
+	cs, _ := v.constraints()
+	for _, c := range cs {
+		descs = append(descs, c.desc)
+	}
+	if v.Type == VarList {
+		if len(descs) == 0 {
+			return []string{"a list"}
+		}
+		return []string{"a list whose elements are " + strings.Join(descs, " and ")}
+	}
+	return descs
+}
+
+type varConstraint struct {
+	desc string
+	ok   func(value string) bool
+}
+
+// constraints returns the constraints on the value. It returns an error if the
+// pattern is not a valid regular expression.
+func (v *Var) constraints() ([]varConstraint, error) {
+	var cs []varConstraint
+	switch v.Type {
+	case VarInt:
+		cs = append(cs, varConstraint{"an integer", func(value string) bool {
+			_, err := strconv.ParseInt(value, 10, 64)
+			return err == nil
+		}})
+	case VarBool:
+		cs = append(cs, varConstraint{"a boolean", func(value string) bool {
+			_, err := strconv.ParseBool(value)
+			return err == nil
+		}})
+	}
+	if len(v.Choices) > 0 {
+		quoted := make([]string, len(v.Choices))
+		for i, choice := range v.Choices {
+			quoted[i] = strconv.Quote(choice)
+		}
+		cs = append(cs, varConstraint{"one of " + strings.Join(quoted, ", "), func(value string) bool {
+			for _, choice := range v.Choices {
+				if value == choice {
+					return true
+				}
+			}
+			return false
+		}})
+	}
+	if v.Pattern != "" {
+		re := v.re
+		if re == nil {
+			var err error
+			if re, err = compilePattern(v.Pattern); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %v", v.Pattern, err)
+			}
+		}
+		cs = append(cs, varConstraint{fmt.Sprintf("matching %q", v.Pattern), re.MatchString})
+	}
+	if v.MinLen > 0 {
+		cs = append(cs, varConstraint{fmt.Sprintf("at least %d characters long", v.MinLen), func(value string) bool {
+			return utf8.RuneCountInString(value) >= v.MinLen
+		}})
+	}
+	if v.MaxLen > 0 {
+		cs = append(cs, varConstraint{fmt.Sprintf("at most %d characters long", v.MaxLen), func(value string) bool {
+			return utf8.RuneCountInString(value) <= v.MaxLen
+		}})
+	}
+	return cs, nil
+}
+
+// compilePattern compiles a pattern that must match the whole value.
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// The attributes supported by var declarations.
+var varAttrs = map[string]func(*Var, *parse.SExpr) error{
+	"choices": evalVarChoices,
+	"default": evalVarDefault,
+	"doc":     evalVarDoc,
+	"maxlen":  evalVarMaxLen,
+	"minlen":  evalVarMinLen,
+	"pattern": evalVarPattern,
+	"type":    evalVarType,
+}
+
+var validVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// VarsFile returns the variables declared in the given file and the files it
+// includes and imports, in the order they are declared. The arguments are the
+// same as for InterpretFile.
+//
+// If the file has syntax errors, the variables declared in the rest of the file
+// are returned along with the error.
+func (i *Interpreter) VarsFile(r io.Reader, filename string) ([]*Var, error) {
+	source, err := readSource(r, filename)
+	if err != nil {
+		return nil, err
+	}
+	l := newLoader(i.Stderr)
+	_, loadErr := l.load(filename, ".", source)
+	if len(l.order) == 0 {
+		return nil, loadErr
+	}
+	vars, err := l.vars()
+	if err != nil {
+		return nil, err
+	}
+	return vars, loadErr
+}
+
+// varValues returns the values and lists of the variables: the defaults of the
+// given declarations, overridden by the given values and lists. The default of
+// a list variable is split into a list.
+func varValues(decls []*Var, given map[string]string, lists map[string][]string) (map[string]string, map[string][]string) {
+	values := map[string]string{}
+	allLists := map[string][]string{}
+	for _, v := range decls {
+		_, isGiven := given[v.Name]
+		_, isList := lists[v.Name]
+		switch {
+		case !v.HasDefault || isGiven || isList:
+		case v.Type == VarList:
+			allLists[v.Name] = splitList(v.Default)
+		default:
+			values[v.Name] = v.Default
+		}
+	}
+	for name, value := range given {
+		values[name] = value
+	}
+	for name, list := range lists {
+		allLists[name] = list
+	}
+	return values, allLists
+}
+
+// validateVars returns an error if the value of any of the given declarations
+// is invalid. Variables without a value are reported when they are substituted.
+func validateVars(decls []*Var, values map[string]string, lists map[string][]string) error {
+	for _, v := range decls {
+		var err error
+		if value, ok := values[v.Name]; ok {
+			err = v.Validate(value)
+		} else if list, ok := lists[v.Name]; ok {
+			err = v.ValidateList(list)
+		}
+		if err != nil {
+			return fmt.Errorf("%w %q: %v", errInvalidVar, v.Name, err)
+		}
+	}
+	return nil
+}
+
+func readSource(r io.Reader, filename string) ([]byte, error) {
+	if r != nil {
+		return ioutil.ReadAll(r)
+	}
+	if filename == "" {
+		return nil, errors.New("the caller must provide a non-nil reader or the path to a file")
+	}
+	return ioutil.ReadFile(filename)
+}
+
+func evalVars(t *parse.Tree) ([]*Var, error) {
+	var vars []*Var
+	seen := map[string]bool{}
+	for _, e := range t.SExprs {
+		if e.Literal.Token.Kind != parse.VarTokenKind {
+			continue
+		}
+		v, err := evalVar(e)
+		if err != nil {
+			return nil, err
+		}
+		if seen[v.Name] {
+			return nil, evalErrorf(e.Args[0].Token, codeInvalidArgument, "variable %q is already declared", v.Name)
+		}
+		seen[v.Name] = true
+		vars = append(vars, v)
+	}
+	return vars, nil
+}
+
+func evalVar(e *parse.SExpr) (*Var, error) {
+	if len(e.Args) < 1 {
+		return nil, evalErrorf(e.Literal.Token, codeMissingArgument, "expected a variable name")
+	}
+	name, err := evalString(constScope, e.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case name == "root_dir":
+		return nil, evalErrorf(e.Args[0].Token, codeInvalidArgument, "cannot declare variable 'root_dir'")
+	case !validVarName.MatchString(name):
+		return nil, evalErrorf(e.Args[0].Token, codeInvalidArgument, "invalid variable name %q", name)
+	}
+
+	v := &Var{Name: name}
+	var def *parse.SExpr
+	for _, arg := range e.Args[1:] {
+		if arg.SExpr == nil {
+			return nil, evalErrorf(arg.Token, codeInvalidExpression, "unexpected %v in var", arg.Token.Value)
+		}
+		if err := evalVarAttr(v, arg.SExpr); err != nil {
+			return nil, err
+		}
+		if arg.SExpr.Literal.Token.Value == "@default" {
+			def = arg.SExpr
+		}
+	}
+	if def != nil {
+		if err := v.Validate(v.Default); err != nil {
+			return nil, evalErrorf(def.Args[0].Token, codeInvalidArgument, "invalid default: %v", err)
+		}
+	}
+	return v, nil
+}
+
+func evalVarAttr(v *Var, e *parse.SExpr) error {
+	attr, err := evalAttrName(e.Literal)
+	if err != nil {
+		return err
+	}
+	if eval, ok := varAttrs[attr]; ok {
+		return eval(v, e)
+	}
+	return evalErrorf(e.Literal.Token, codeInvalidAttribute, "invalid var attribute %q", attr)
+}
+
+func evalVarDefault(v *Var, e *parse.SExpr) (err error) {
+	if len(e.Args) < 1 {
+		return evalErrorf(e.Literal.Token, codeMissingArgument, "expected a default value")
+	}
+	v.Default, err = evalString(constScope, e.Args[0])
+	v.HasDefault = err == nil
+	return err
+}
+
+func evalVarDoc(v *Var, e *parse.SExpr) (err error) {
+	if len(e.Args) < 1 {
+		return evalErrorf(e.Literal.Token, codeMissingArgument, "expected a description")
+	}
+	v.Doc, err = evalString(constScope, e.Args[0])
+	return err
+}
+
+func evalVarType(v *Var, e *parse.SExpr) error {
+	if len(e.Args) < 1 {
+		return evalErrorf(e.Literal.Token, codeMissingArgument, "expected a type")
+	}
+	name, err := evalString(constScope, e.Args[0])
+	if err != nil {
+		return err
+	}
+	switch t := VarType(name); t {
+	case VarString, VarInt, VarBool, VarList:
+		v.Type = t
+		return nil
+	}
+	return evalErrorf(e.Args[0].Token, codeInvalidArgument, "invalid type %q: must be one of string, int, bool or list", name)
+}
+
+func evalVarPattern(v *Var, e *parse.SExpr) error {
+	if len(e.Args) < 1 {
+		return evalErrorf(e.Literal.Token, codeMissingArgument, "expected a regular expression")
+	}
+	pattern, err := evalString(constScope, e.Args[0])
+	if err != nil {
+		return err
+	}
+	re, err := compilePattern(pattern)
+	if err != nil {
+		return evalErrorf(e.Args[0].Token, codeInvalidArgument, "invalid pattern: %v", err)
+	}
+	v.Pattern, v.re = pattern, re
+	return nil
+}
+
+func evalVarChoices(v *Var, e *parse.SExpr) error {
+	if len(e.Args) < 1 {
+		return evalErrorf(e.Literal.Token, codeMissingArgument, "expected one or more choices")
+	}
+	for _, arg := range e.Args {
+		choice, err := evalString(constScope, arg)
+		if err != nil {
+			return err
+		}
+		v.Choices = append(v.Choices, choice)
+	}
+	return nil
+}
+
+func evalVarMinLen(v *Var, e *parse.SExpr) (err error) {
+	v.MinLen, err = evalLength(e)
+	return err
+}
+
+func evalVarMaxLen(v *Var, e *parse.SExpr) (err error) {
+	v.MaxLen, err = evalLength(e)
+	return err
+}
+
+func evalLength(e *parse.SExpr) (int, error) {
+	if len(e.Args) < 1 {
+		return 0, evalErrorf(e.Literal.Token, codeMissingArgument, "expected a length")
+	}
+	value, err := evalNumber(constScope, e.Args[0])
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, evalErrorf(e.Args[0].Token, codeInvalidArgument, "invalid length %q", value)
+	}
+	return n, nil
+}
@@ -0,0 +1,70 @@
+package mktree
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestInterpreter_VarsFile(t *testing.T) {
+	source := `
+(var "name" (@doc "The project name.") (@default "hello"))
+(var "license" (@choices "mit" "apache"))
+(var "count" (@type "int") (@minlen 1) (@maxlen 3))
+(dir "%(name)" (file "LICENSE" (@contents "%(license)")))
+`
+	i := &Interpreter{}
+	got, err := i.VarsFile(strings.NewReader(source), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Var{
+		{Name: "name", Doc: "The project name.", Default: "hello", HasDefault: true},
+		{Name: "license", Choices: []string{"mit", "apache"}},
+		{Name: "count", Type: VarInt, MinLen: 1, MaxLen: 3},
+	}
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreUnexported(Var{})); diff != "" {
+		t.Errorf("got unexpected vars (-want,+got):\n%s", diff)
+	}
+
+	if _, err := i.VarsFile(strings.NewReader(`(var "a" (@default))`), ""); err == nil {
+		t.Error("expected an error but got nil")
+	}
+}
+
+func TestVar_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		v       *Var
+		value   string
+		wantErr bool
+	}{
+		{name: "string", v: &Var{}, value: "anything"},
+		{name: "int", v: &Var{Type: VarInt}, value: "-42"},
+		{name: "int_invalid", v: &Var{Type: VarInt}, value: "4.2", wantErr: true},
+		{name: "bool", v: &Var{Type: VarBool}, value: "true"},
+		{name: "bool_invalid", v: &Var{Type: VarBool}, value: "yes", wantErr: true},
+		{name: "choice", v: &Var{Choices: []string{"mit", "apache"}}, value: "apache"},
+		{name: "choice_invalid", v: &Var{Choices: []string{"mit", "apache"}}, value: "MIT", wantErr: true},
+		{name: "pattern", v: &Var{Pattern: "[a-z]+"}, value: "hello"},
+		{name: "pattern_must_match_whole_value", v: &Var{Pattern: "[a-z]+"}, value: "hello world", wantErr: true},
+		{name: "pattern_invalid", v: &Var{Pattern: "[a-z"}, value: "hello", wantErr: true},
+		{name: "list_pattern_invalid", v: &Var{Type: VarList, Pattern: "("}, value: "a", wantErr: true},
+		{name: "minlen", v: &Var{MinLen: 2}, value: "héé"},
+		{name: "minlen_invalid", v: &Var{MinLen: 2}, value: "é", wantErr: true},
+		{name: "maxlen", v: &Var{MaxLen: 3}, value: "héé"},
+		{name: "maxlen_invalid", v: &Var{MaxLen: 3}, value: "héél", wantErr: true},
+		{name: "list", v: &Var{Type: VarList, Choices: []string{"a", "b"}}, value: "a, b"},
+		{name: "list_invalid", v: &Var{Type: VarList, Choices: []string{"a", "b"}}, value: "a,c", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.v.Validate(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate(%q) = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+		})
+	}
+}
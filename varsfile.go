@@ -0,0 +1,237 @@
+package mktree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ReadVarsFile reads the variables in the named file. The format is chosen by
+// the file's extension:
+//
+//	.json          A JSON object.
+//	.yaml or .yml  A YAML mapping.
+//	.toml          A TOML table.
+//	.env           KEY=VALUE lines, as read by dotenv.
+//
+// Values must be strings, numbers or booleans, or lists of them except in .env
+// files. Numbers and booleans are converted to strings. The values of list
+// variables are returned in lists.
+func ReadVarsFile(filename string) (vars map[string]string, lists map[string][]string, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch ext := strings.ToLower(filepath.Ext(filename)); ext {
+	case ".json":
+		vars, lists, err = parseJSONVars(data)
+	case ".yaml", ".yml":
+		vars, lists, err = parseYAMLVars(data)
+	case ".toml":
+		vars, lists, err = parseTOMLVars(data)
+	case ".env":
+		vars, err = parseDotenvVars(data)
+		lists = map[string][]string{}
+	default:
+		return nil, nil, fmt.Errorf("unknown variables file format for %q: must end with .json, .yaml, .yml, .toml or .env", filename)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return vars, lists, nil
+}
+
+// givenVars returns the variables set by i.VarsFiles and i.Vars, which override
+// the variables in the files. A variable is either in vars or in lists.
+func (i *Interpreter) givenVars() (vars map[string]string, lists map[string][]string, err error) {
+	vars = map[string]string{}
+	lists = map[string][]string{}
+	for _, filename := range i.VarsFiles {
+		fileVars, fileLists, err := ReadVarsFile(filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		_, isVar := fileVars["root_dir"]
+		_, isList := fileLists["root_dir"]
+		if isVar || isList {
+			return nil, nil, fmt.Errorf("%s: cannot set variable 'root_dir'", filename)
+		}
+		for name, value := range fileVars {
+			vars[name] = value
+			delete(lists, name)
+		}
+		for name, value := range fileLists {
+			lists[name] = value
+			delete(vars, name)
+		}
+	}
+	for name, value := range i.Vars {
+		vars[name] = value
+		delete(lists, name)
+	}
+	return vars, lists, nil
+}
+
+func parseJSONVars(data []byte) (map[string]string, map[string][]string, error) {
+	var values map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&values); err != nil {
+		return nil, nil, err
+	}
+	return decodedVars(values)
+}
+
+func parseYAMLVars(data []byte) (map[string]string, map[string][]string, error) {
+	// Decode into nodes to keep scalars as written, so that "0755" is not
+	// read as a number.
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, err
+	}
+	vars := map[string]string{}
+	lists := map[string][]string{}
+	if len(doc.Content) == 0 {
+		return vars, lists, nil
+	}
+	m := doc.Content[0]
+	if m.Kind != yaml.MappingNode {
+		return nil, nil, fmt.Errorf("line %d: expected a mapping of variables", m.Line)
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		k, v := m.Content[i], m.Content[i+1]
+		switch v.Kind {
+		case yaml.ScalarNode:
+			vars[k.Value] = yamlScalar(v)
+			continue
+		case yaml.SequenceNode:
+			list := []string{}
+			for _, elem := range v.Content {
+				if elem.Kind != yaml.ScalarNode {
+					return nil, nil, fmt.Errorf("line %d: the elements of variable %q must be strings, numbers or booleans", elem.Line, k.Value)
+				}
+				list = append(list, yamlScalar(elem))
+			}
+			lists[k.Value] = list
+			continue
+		}
+		return nil, nil, fmt.Errorf("line %d: variable %q must be a string, number, boolean or list", v.Line, k.Value)
+	}
+	return vars, lists, nil
+}
+
+func yamlScalar(n *yaml.Node) string {
+	if n.Tag == "!!null" {
+		return ""
+	}
+	return n.Value
+}
+
+func parseTOMLVars(data []byte) (map[string]string, map[string][]string, error) {
+	var values map[string]interface{}
+	if _, err := toml.Decode(string(data), &values); err != nil {
+		return nil, nil, err
+	}
+	return decodedVars(values)
+}
+
+// decodedVars returns the variables in values decoded from JSON or TOML.
+func decodedVars(values map[string]interface{}) (map[string]string, map[string][]string, error) {
+	vars := map[string]string{}
+	lists := map[string][]string{}
+	for name, v := range values {
+		if elems, ok := v.([]interface{}); ok {
+			list := []string{}
+			for _, elem := range elems {
+				value, ok := scalarValue(elem)
+				if !ok {
+					return nil, nil, fmt.Errorf("the elements of variable %q must be strings, numbers or booleans", name)
+				}
+				list = append(list, value)
+			}
+			lists[name] = list
+			continue
+		}
+		value, ok := scalarValue(v)
+		if !ok {
+			return nil, nil, fmt.Errorf("variable %q must be a string, number, boolean or list", name)
+		}
+		vars[name] = value
+	}
+	return vars, lists, nil
+}
+
+func scalarValue(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", true
+	case string:
+		return v, true
+	case bool, int64, float64, json.Number:
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
+
+// parseDotenvVars parses KEY=VALUE lines. Blank lines and lines starting with
+// '#' are ignored, and a leading "export " is allowed. Values may be double
+// quoted with Go escape sequences, single quoted to be read literally, or
+// unquoted, in which case a " #" starts a comment.
+func parseDotenvVars(data []byte) (map[string]string, error) {
+	vars := map[string]string{}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", n)
+		}
+		name := strings.TrimSpace(line[:eq])
+		if name == "" {
+			return nil, fmt.Errorf("line %d: missing variable name", n)
+		}
+		value, err := dotenvValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		vars[name] = value
+	}
+	return vars, s.Err()
+}
+
+func dotenvValue(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				return strconv.Unquote(s[:i+1])
+			}
+		}
+		return "", fmt.Errorf("unterminated string %s", s)
+	case strings.HasPrefix(s, "'"):
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated string %s", s)
+		}
+		return s[1 : end+1], nil
+	}
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s), nil
+}
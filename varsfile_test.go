@@ -0,0 +1,181 @@
+package mktree
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestReadVarsFile(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		want      map[string]string
+		wantLists map[string][]string
+		wantErr   bool
+	}{
+		{
+			name:      "vars.json",
+			data:      `{"name": "hello", "count": 3, "ratio": 1.5, "ok": true, "none": null, "list": ["a", 1, true], "empty": []}`,
+			want:      map[string]string{"name": "hello", "count": "3", "ratio": "1.5", "ok": "true", "none": ""},
+			wantLists: map[string][]string{"list": {"a", "1", "true"}, "empty": {}},
+		},
+		{
+			name:    "nested_list.json",
+			data:    `{"list": [["a"]]}`,
+			wantErr: true,
+		},
+		{
+			name:      "vars.yaml",
+			data:      "name: hello\nperms: 0755\nok: true\nnone:\nlist: [a, 0755]\n",
+			want:      map[string]string{"name": "hello", "perms": "0755", "ok": "true", "none": ""},
+			wantLists: map[string][]string{"list": {"a", "0755"}},
+		},
+		{
+			name:    "vars.yml",
+			data:    "name: {a: b}\n",
+			wantErr: true,
+		},
+		{
+			name:      "vars.toml",
+			data:      "name = \"hello\"\ncount = 3\nok = false\nlist = [\"a\", \"b\"]\n",
+			want:      map[string]string{"name": "hello", "count": "3", "ok": "false"},
+			wantLists: map[string][]string{"list": {"a", "b"}},
+		},
+		{
+			name:    "nested.toml",
+			data:    "[table]\nname = \"hello\"\n",
+			wantErr: true,
+		},
+		{
+			name: ".env",
+			data: strings.Join([]string{
+				"# A comment.",
+				"",
+				"NAME=hello",
+				"export LICENSE = MIT # The license.",
+				`QUOTED="a \"b\"\n" # Escaped.`,
+				`LITERAL='a\nb'`,
+				"EMPTY=",
+			}, "\n"),
+			want: map[string]string{
+				"NAME":    "hello",
+				"LICENSE": "MIT",
+				"QUOTED":  "a \"b\"\n",
+				"LITERAL": `a\nb`,
+				"EMPTY":   "",
+			},
+		},
+		{
+			name:    "invalid.env",
+			data:    "NAME",
+			wantErr: true,
+		},
+		{
+			name:    "vars.ini",
+			data:    "name=hello",
+			wantErr: true,
+		},
+	}
+
+	dir := tempDir(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(dir, tt.name)
+			if err := ioutil.WriteFile(filename, []byte(tt.data), 0666); err != nil {
+				t.Fatal(err)
+			}
+			got, gotLists, err := ReadVarsFile(filename)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ReadVarsFile(%q) wanted an error but got %v", tt.data, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("got unexpected vars (-want,+got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.wantLists, gotLists, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("got unexpected lists (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestInterpreter_VarsFiles(t *testing.T) {
+	dir := tempDir(t)
+	a := filepath.Join(dir, "a.json")
+	b := filepath.Join(dir, "b.env")
+	if err := ioutil.WriteFile(a, []byte(`{"x": "a", "y": "a", "z": "a"}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(b, []byte("y=b\nz=b\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	i := &Interpreter{
+		Root:      "[test_root]",
+		Vars:      map[string]string{"z": "c"},
+		VarsFiles: []string{a, b},
+	}
+	tree, err := i.InterpretFile(strings.NewReader(`(file "%(x)%(y)%(z)")`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tree.root.files[0].name, "[test_root]/abc"; got != want {
+		t.Errorf("got file %q, want %q", got, want)
+	}
+}
+
+func TestInterpreter_ListVars(t *testing.T) {
+	src := writeSourceFiles(t, map[string]string{
+		"layout.tree": `
+(var "services" (@type "list") (@choices "api" "web" "worker"))
+(for svc in services
+	(dir svc (file "main.go" (@template "main.tmpl"))))
+`,
+		"main.tmpl": `package {{ Var "svc" }}`,
+		"vars.yaml": "services: [api, web]\n",
+	})
+	root := filepath.Join(tempDir(t), "out")
+	i := &Interpreter{Root: root, VarsFiles: []string{filepath.Join(src, "vars.yaml")}}
+	if err := i.ExecFile(nil, filepath.Join(src, "layout.tree")); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, OSFS{}, filepath.Join(root, "api/main.go"), defaultFileMode, "package api")
+	assertFile(t, OSFS{}, filepath.Join(root, "web/main.go"), defaultFileMode, "package web")
+
+	i = &Interpreter{Root: root, Vars: map[string]string{"services": "api,other"}}
+	if err := i.ExecFile(nil, filepath.Join(src, "layout.tree")); !errors.Is(err, errInvalidVar) {
+		t.Errorf("ExecFile with an invalid element wanted a %v but got %v", errInvalidVar, err)
+	}
+
+	i = &Interpreter{Root: root, VarsFiles: []string{filepath.Join(src, "vars.yaml")}}
+	if _, err := i.InterpretFile(strings.NewReader(`(file "%(services)")`), ""); err == nil {
+		t.Error("InterpretFile wanted an error for a list in a string but got nil")
+	}
+}
+
+func TestInterpreter_ListVarDefaults(t *testing.T) {
+	src := writeSourceFiles(t, map[string]string{
+		"layout.tree": `
+(var "services" (@type "list") (@default "api, web"))
+(file "services" (@template "services.tmpl"))
+`,
+		"services.tmpl": `{{ range .Vars.services }}[{{ . }}]{{ end }}`,
+	})
+	root := filepath.Join(tempDir(t), "out")
+	i := &Interpreter{Root: root}
+	if err := i.ExecFile(nil, filepath.Join(src, "layout.tree")); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, OSFS{}, filepath.Join(root, "services"), defaultFileMode, "[api][web]")
+}